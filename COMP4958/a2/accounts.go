@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Account is a registered nickname protected by a password
+type Account struct {
+	Salt    []byte    `json:"salt"`
+	Hash    []byte    `json:"hash"`
+	Created time.Time `json:"created"`
+	Ignores []string  `json:"ignores,omitempty"` // Nicknames the owner is ignoring
+}
+
+// AccountStore keeps registered nicknames and their salted password hashes
+type AccountStore struct {
+	mu       sync.Mutex          // mutex to protect accounts
+	path     string              // File the accounts are persisted to
+	accounts map[string]*Account // map of nicknames to accounts
+}
+
+// NewAccountStore creates an account store, loading any accounts previously saved at path
+func NewAccountStore(path string) (*AccountStore, error) {
+	a := &AccountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+	}
+	if err := readJSONFile(path, &a.accounts); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// hashPassword derives the stored hash of a password with the given salt.
+// It only fails under FIPS restrictions on short keys, which we never use.
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, 100000, 32)
+}
+
+// Exists reports whether a nickname is registered
+func (a *AccountStore) Exists(nickname string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, exists := a.accounts[nickname]
+	return exists
+}
+
+// Count returns how many nicknames are registered
+func (a *AccountStore) Count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.accounts)
+}
+
+// Register creates an account for a nickname with the given password
+func (a *AccountStore) Register(nickname, password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.accounts[nickname]; exists {
+		return fmt.Errorf("nickname %s is already registered", nickname)
+	}
+	a.accounts[nickname] = &Account{Salt: salt, Hash: hash, Created: time.Now()}
+	return writeJSONFile(a.path, a.accounts)
+}
+
+// Verify checks a password against the account of a nickname, a password
+// that can't be hashed matches nothing
+func (a *AccountStore) Verify(nickname, password string) bool {
+	a.mu.Lock()
+	account, exists := a.accounts[nickname]
+	a.mu.Unlock()
+
+	if !exists {
+		// Hash anyway so unknown nicknames take as long as wrong passwords
+		hashPassword(password, make([]byte, 16))
+		return false
+	}
+	hash, err := hashPassword(password, account.Salt)
+	return err == nil && subtle.ConstantTimeCompare(hash, account.Hash) == 1
+}
+
+// Created returns when a nickname was registered
+func (a *AccountStore) Created(nickname string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, exists := a.accounts[nickname]
+	if !exists {
+		return time.Time{}, false
+	}
+	return account.Created, true
+}
+
+// Ignores returns the nicknames ignored by the owner of an account
+func (a *AccountStore) Ignores(nickname string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, exists := a.accounts[nickname]
+	if !exists {
+		return nil
+	}
+	return slices.Clone(account.Ignores)
+}
+
+// SetIgnores saves the nicknames ignored by the owner of an account
+func (a *AccountStore) SetIgnores(nickname string, ignores []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account, exists := a.accounts[nickname]
+	if !exists {
+		return fmt.Errorf("nickname %s is not registered", nickname)
+	}
+	account.Ignores = ignores
+	return writeJSONFile(a.path, a.accounts)
+}
+
+// setAccount records the account a client has identified as, returning
+// the account it had before
+func (s *Server) setAccount(client *Client, account string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := client.account
+	client.account = account
+	return previous
+}
+
+// reserved explains why a client may not take a nickname registered to
+// another account, or returns "" if it may. Registering and changing
+// nicknames both go through here, so the rule doesn't depend on the path.
+func (s *Server) reserved(nickname string, client *Client) string {
+	if s.config.ReserveNicks && s.accounts.Exists(nickname) && client.account != nickname {
+		return fmt.Sprintf("Nickname %s is registered, use /IDENTIFY %s <password>", nickname, nickname)
+	}
+	return ""
+}
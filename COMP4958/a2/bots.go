@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot is a chat bot running inside the server. Its handlers are called one
+// at a time from the bot's own goroutine, so they may block or call back
+// into the server, e.g. through BotClient.Send.
+type Bot interface {
+	OnMessage(b *BotClient, ev Event)            // A message was sent to the bot, or to a room or everyone
+	OnJoin(b *BotClient, nickname, room string)  // A user joined a room the bot is in, or the chat when room is empty
+	OnLeave(b *BotClient, nickname, room string) // A user left a room the bot is in, or the chat when room is empty
+}
+
+// BotStarter is implemented by bots that do work of their own, such as
+// watching a file, Start is called once the bot is online
+type BotStarter interface {
+	Start(b *BotClient)
+}
+
+// BotClient is a bot's seat in the chat, a pseudo-client in Server.clients
+// whose messages come from the bot instead of a connection
+type BotClient struct {
+	server   *Server
+	client   *Client
+	bot      Bot
+	nickname string
+
+	stopped  chan struct{} // closed when the bot leaves the chat
+	stopOnce sync.Once     // closes stopped once
+}
+
+// Nickname returns the bot's nickname
+func (b *BotClient) Nickname() string {
+	return b.nickname
+}
+
+// Send sends a message from the bot, to the same recipients /MSG accepts.
+// Bots are held to the same rate limits as users, so two bots answering
+// each other run out of budget instead of looping forever.
+func (b *BotClient) Send(recipients, message string) SendResult {
+	if ok, wait := b.server.AllowMessage(b.client, b.nickname, recipients == "*" || strings.Contains(recipients, "#")); !ok {
+		b.server.logger.Printf("Bot %s is rate limited, dropped a message to %s", b.nickname, recipients)
+		return SendResult{Rejected: fmt.Sprintf("Rate limited, retry in %.1fs", wait.Seconds())}
+	}
+	return b.server.SendMessage(b.nickname, recipients, message)
+}
+
+// SendWait is Send for bots that must not lose a message, such as a relay
+// of alerts. Out of budget, it waits for the next token instead of dropping
+// the message, and only gives up when the bot stops.
+func (b *BotClient) SendWait(recipients, message string) SendResult {
+	broadcast := recipients == "*" || strings.Contains(recipients, "#")
+	for {
+		ok, wait := b.server.AllowMessage(b.client, b.nickname, broadcast)
+		if ok {
+			return b.server.SendMessage(b.nickname, recipients, message)
+		}
+		select {
+		case <-b.stopped:
+			return SendResult{Rejected: "Bot stopped"}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Join joins the bot to a room
+func (b *BotClient) Join(room string) (bool, string) {
+	return b.server.JoinRoom(b.nickname, room)
+}
+
+// Done is closed once the bot has left the chat, for bots running goroutines of their own
+func (b *BotClient) Done() <-chan struct{} {
+	return b.stopped
+}
+
+// stop takes the bot out of the chat, it is safe to call with s.mu held
+func (b *BotClient) stop() {
+	b.stopOnce.Do(func() { close(b.stopped) })
+}
+
+// run hands the bot its events until it is stopped
+func (b *BotClient) run() {
+	defer b.server.removeBot(b)
+	for {
+		select {
+		case ev := <-b.client.outCh:
+			b.dispatch(ev)
+			b.server.acknowledge(ev)
+		case <-b.stopped:
+			return
+		}
+	}
+}
+
+// dispatch calls the bot's handler for one event, a panicking bot is
+// logged and carries on rather than taking the server down
+func (b *BotClient) dispatch(ev Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			b.server.logger.Printf("Bot %s failed handling a %s event: %v", b.nickname, ev.Type, err)
+		}
+	}()
+
+	switch ev.Type {
+	case "message":
+		// A bot never answers itself
+		if ev.From != b.nickname {
+			b.bot.OnMessage(b, ev)
+		}
+	case "join":
+		b.bot.OnJoin(b, ev.From, ev.To)
+	case "leave":
+		b.bot.OnLeave(b, ev.From, ev.To)
+	}
+}
+
+// AddBot brings a bot into the chat under a nickname, as if it had
+// connected and sent /NICK, and joins it to the given rooms
+func (s *Server) AddBot(nickname string, bot Bot, rooms ...string) (*BotClient, error) {
+	b := &BotClient{
+		server:   s,
+		bot:      bot,
+		nickname: nickname,
+		stopped:  make(chan struct{}),
+	}
+	b.client = &Client{
+		outCh:       make(chan Event, 100), // Bots keep up, but alerts and broadcasts come in bursts
+		bot:         b,
+		limits:      newRateLimits(s.config),
+		connectedAt: time.Now(),
+	}
+	b.client.lastActive.Store(b.client.connectedAt.UnixNano())
+
+	if success, msg := s.RegisterClient(nickname, b.client); !success {
+		return nil, fmt.Errorf("bot %s: %s", nickname, msg)
+	}
+	s.mu.Lock()
+	s.bots[nickname] = b
+	s.mu.Unlock()
+	s.logger.Printf("Bot %s joined the chat", nickname)
+
+	go b.run()
+	for _, room := range rooms {
+		if success, msg := b.Join(room); !success {
+			s.logger.Printf("Bot %s could not join %s: %s", nickname, room, msg)
+		}
+	}
+	if starter, ok := bot.(BotStarter); ok {
+		go starter.Start(b)
+	}
+	return b, nil
+}
+
+// removeBot unregisters a stopped bot, unless its nickname has since
+// been taken over, e.g. by a collision with another server
+func (s *Server) removeBot(b *BotClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bots[b.nickname] == b {
+		delete(s.bots, b.nickname)
+	}
+	if s.clients[b.nickname] == b.client {
+		s.unregister(b.nickname)
+	}
+	s.logger.Printf("Bot %s left the chat", b.nickname)
+}
+
+// notifyBots tells bots that a user joined or left, kind is "join" or
+// "leave". Only bots in the room hear about a room, all of them hear about
+// the chat as a whole when room is nil. The caller must hold s.mu.
+func (s *Server) notifyBots(kind, nickname string, room *Room) {
+	ev := Event{Type: kind, From: nickname, Time: time.Now()}
+	if room != nil {
+		ev.To = room.name
+	}
+	for name, b := range s.bots {
+		if name == nickname {
+			continue
+		}
+		if room != nil {
+			if _, member := room.members[name]; !member {
+				continue
+			}
+		}
+		s.deliver(name, b.client, ev)
+	}
+}
+
+// BotConfig describes one bot in the bots file
+type BotConfig struct {
+	Nickname string   `json:"nickname"`
+	Type     string   `json:"type"`             // echo, reminder or relay
+	Rooms    []string `json:"rooms,omitempty"`  // Rooms the bot joins on start
+	Source   string   `json:"source,omitempty"` // relay: file or named pipe alerts are read from
+	To       string   `json:"to,omitempty"`     // relay: recipients of the alerts, as for /MSG
+}
+
+// botTypes makes the bots the bots file can name
+var botTypes = map[string]func(cfg BotConfig) (Bot, error){
+	"echo": func(cfg BotConfig) (Bot, error) {
+		return EchoBot{}, nil
+	},
+	"reminder": func(cfg BotConfig) (Bot, error) {
+		return &ReminderBot{}, nil
+	},
+	"relay": func(cfg BotConfig) (Bot, error) {
+		if cfg.Source == "" || cfg.To == "" {
+			return nil, errors.New("a relay bot needs a source and a to")
+		}
+		return &RelayBot{Source: cfg.Source, To: cfg.To}, nil
+	},
+}
+
+// LoadBots starts the bots listed in a JSON bots file, e.g.
+// [{"nickname": "echo", "type": "echo", "rooms": ["#lobby"]}]
+func (s *Server) LoadBots(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []BotConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, cfg := range configs {
+		newBot, exists := botTypes[cfg.Type]
+		if !exists {
+			return fmt.Errorf("bot %s: unknown type %q", cfg.Nickname, cfg.Type)
+		}
+		bot, err := newBot(cfg)
+		if err != nil {
+			return fmt.Errorf("bot %s: %w", cfg.Nickname, err)
+		}
+		if _, err := s.AddBot(cfg.Nickname, bot, cfg.Rooms...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EchoBot repeats direct messages back to their sender, and room messages
+// that start with !echo back to the room
+type EchoBot struct{}
+
+func (EchoBot) OnMessage(b *BotClient, ev Event) {
+	switch {
+	case ev.To == b.Nickname():
+		b.Send(ev.From, ev.Body)
+	case strings.HasPrefix(ev.To, "#"):
+		if text, ok := strings.CutPrefix(ev.Body, "!echo "); ok {
+			b.Send(ev.To, text)
+		}
+	}
+}
+
+func (EchoBot) OnJoin(b *BotClient, nickname, room string)  {}
+func (EchoBot) OnLeave(b *BotClient, nickname, room string) {}
+
+// ReminderBot sends users a reminder after a delay, asked for with a
+// direct message such as "10m stretch your legs"
+type ReminderBot struct {
+	mu      sync.Mutex
+	pending map[string][]*time.Timer // reminders by nickname, dropped when the user leaves
+}
+
+func (r *ReminderBot) OnMessage(b *BotClient, ev Event) {
+	if ev.To != b.Nickname() {
+		return
+	}
+	delay, text, _ := strings.Cut(strings.TrimSpace(ev.Body), " ")
+	d, err := time.ParseDuration(delay)
+	if err != nil || d <= 0 || text == "" {
+		b.Send(ev.From, "Tell me when and what, e.g. 10m stretch your legs")
+		return
+	}
+
+	nickname := ev.From
+	r.mu.Lock()
+	if r.pending == nil {
+		r.pending = make(map[string][]*time.Timer)
+	}
+	// The timer only reads itself under r.mu, once it has been added
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		r.forget(nickname, timer)
+		r.mu.Unlock()
+		b.Send(nickname, "Reminder: "+text)
+	})
+	r.pending[nickname] = append(r.pending[nickname], timer)
+	r.mu.Unlock()
+	b.Send(nickname, fmt.Sprintf("I'll remind you in %v", d))
+}
+
+// forget drops a reminder that has fired, r.mu must be held
+func (r *ReminderBot) forget(nickname string, timer *time.Timer) {
+	timers := slices.DeleteFunc(r.pending[nickname], func(t *time.Timer) bool { return t == timer })
+	if len(timers) == 0 {
+		delete(r.pending, nickname)
+	} else {
+		r.pending[nickname] = timers
+	}
+}
+
+func (r *ReminderBot) OnJoin(b *BotClient, nickname, room string) {}
+
+func (r *ReminderBot) OnLeave(b *BotClient, nickname, room string) {
+	if room != "" {
+		return
+	}
+	// Reminders would only end up in the mailbox, so they go with the user
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, timer := range r.pending[nickname] {
+		timer.Stop()
+	}
+	delete(r.pending, nickname)
+}
+
+// RelayBot sends every line written to a file or named pipe to a room,
+// a user or everyone, e.g. alerts from a monitoring script. Alerts beyond
+// the bot's rate limit wait their turn rather than being dropped.
+type RelayBot struct {
+	Source string // File or named pipe to read
+	To     string // Recipients, as for /MSG
+}
+
+func (r *RelayBot) OnMessage(b *BotClient, ev Event)            {}
+func (r *RelayBot) OnJoin(b *BotClient, nickname, room string)  {}
+func (r *RelayBot) OnLeave(b *BotClient, nickname, room string) {}
+
+// Start follows the source until the bot stops. A named pipe is reopened
+// whenever its writer closes it, a regular file is followed like tail -f
+// from its end.
+func (r *RelayBot) Start(b *BotClient) {
+	// Only members may send to a room
+	if strings.HasPrefix(r.To, "#") {
+		b.Join(r.To)
+	}
+	for {
+		if err := r.follow(b); err != nil {
+			b.server.logger.Printf("Bot %s: %v", b.Nickname(), err)
+		}
+		select {
+		case <-b.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// follow relays lines from one opening of the source
+func (r *RelayBot) follow(b *BotClient) error {
+	f, err := os.Open(r.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Closing the file unblocks a read when the bot stops, the goroutine
+	// ends with this opening so reopening a pipe doesn't leave one behind
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.Done():
+			f.Close()
+		case <-done:
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pipe := info.Mode()&os.ModeNamedPipe != 0
+	if !pipe {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			if text := strings.TrimSpace(partial); text != "" {
+				b.SendWait(r.To, text)
+			}
+			partial = ""
+			continue
+		}
+		if err != io.EOF || pipe {
+			// A closed pipe or a failed read ends this opening, Start opens the source again
+			return nil
+		}
+		select {
+		case <-b.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
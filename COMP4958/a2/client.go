@@ -1,14 +1,36 @@
+//go:build ignore
+
+// The client is a separate program, run with go run client.go
+
 package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,44 +41,120 @@ func main() {
 	host := flag.String("host", "localhost", "Server hostname")
 	port := flag.Int("port", 6666, "Server port")
 	timeout := flag.Int("timeout", 30, "Connection timeout in seconds")
+	// TLS options, the server's TLS port defaults to 6697
+	useTLS := flag.Bool("tls", false, "Connect using TLS")
+	caFile := flag.String("ca", "", "Only trust server certificates signed by this CA file (PEM)")
+	insecure := flag.Bool("insecure", false, "Skip server certificate verification (testing only)")
+	certFile := flag.String("cert", "", "Client certificate file (PEM) for mutual TLS")
+	keyFile := flag.String("key", "", "Client private key file (PEM) for mutual TLS")
+	// files other users send are saved in ./downloads
+	downloadDir := flag.String("download-dir", "downloads", "Directory to save received files in")
+	// the full-screen UI is used whenever stdin is a terminal
+	useTUI := flag.Bool("tui", isTerminal(os.Stdin), "Use the full-screen terminal UI")
+	// a lost connection is redialed, waiting at most 30s between attempts
+	reconnect := flag.Bool("reconnect", true, "Reconnect automatically when the connection is lost")
+	maxBackoff := flag.Duration("max-backoff", 30*time.Second, "Longest wait between reconnect attempts")
+	// with -to the client sends and exits, reading the messages from stdin without -message
+	nick := flag.String("nick", "", "Nickname to register as once connected")
+	// a registered nickname is identified with -password, or $CHAT_PASSWORD which other users can't see in ps
+	password := flag.String("password", "", "Password to /IDENTIFY the -nick with before sending with -to (default: $CHAT_PASSWORD)")
+	to := flag.String("to", "", "Send to these recipients (nickname, #room, comma list or *) and exit")
+	message := flag.String("message", "", "Message to send with -to, otherwise each line of stdin is sent")
+	waitReplies := flag.Duration("wait-replies", 0, "How long to print incoming messages after sending with -to")
 	flag.Parse()
 
+	// Read after parsing so that -help doesn't print it as the default
+	if *password == "" {
+		*password = os.Getenv("CHAT_PASSWORD")
+	}
+	if *to != "" && *nick == "" {
+		fmt.Fprintln(os.Stderr, "-to needs a -nick to send as")
+		os.Exit(2)
+	}
+	if *to == "" && (*message != "" || *waitReplies != 0) {
+		fmt.Fprintln(os.Stderr, "-message and -wait-replies only apply with -to")
+		os.Exit(2)
+	}
+
+	if *useTLS && !isFlagSet("port") {
+		*port = 6697
+	}
+
 	// Connect to the server
 	dialer := net.Dialer{Timeout: time.Duration(*timeout) * time.Second}
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", *host, *port))
+	address := net.JoinHostPort(*host, strconv.Itoa(*port))
+	dial := func() (net.Conn, error) {
+		return dialer.Dial("tcp", address)
+	}
+	if *useTLS {
+		config, cfgErr := clientTLSConfig(*host, *caFile, *insecure, *certFile, *keyFile)
+		if cfgErr != nil {
+			fmt.Printf("Error loading TLS configuration: %v\n", cfgErr)
+			os.Exit(1)
+		}
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config}
+		dial = func() (net.Conn, error) {
+			return tlsDialer.Dial("tcp", address)
+		}
+	}
+	conn, err := dial()
 	if err != nil {
 		fmt.Printf("Error connecting to server: %v\n", err)
-		return
+		os.Exit(1)
 	}
-	defer conn.Close()
 
-	fmt.Printf("Connected to chat server at %s:%d\n", *host, *port)
+	// Scripts get an exit status instead of a session
+	if *to != "" {
+		os.Exit(runBatch(conn, *nick, *password, *to, *message, time.Duration(*timeout)*time.Second, *waitReplies))
+	}
+	fmt.Printf("Connected to chat server at %s\n", address)
 
 	// Create a channel to listen for interrupt signals
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	
+
+	sess := &session{conn: conn, done: make(chan struct{})}
+	defer sess.close()
+	files := newTransfers(sess, *downloadDir)
+
+	// The terminal UI takes over the screen and speaks the JSON protocol
+	var ui *tui
+	var uiQuit chan struct{} // closed when the user quits the UI, nil without one
+	if *useTUI {
+		ui, err = newTUI(sess, files)
+		if err != nil {
+			fmt.Printf("Can't start the terminal UI, using plain output: %v\n", err)
+		} else {
+			out = ui
+			uiQuit = ui.quit
+			sess.send("/PROTO json")
+			sess.jsonMode.Store(true)
+			ui.fetchUsers()
+		}
+	}
+	if *nick != "" {
+		submit(sess, files, "/NICK "+*nick)
+	}
+
 	// WaitGroup to wait for goroutines to finish
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Receive messages from the server
+	// Receive messages from the server, redialing whenever the connection drops
+	lost := make(chan struct{}) // closed when the connection is gone for good
 	go func() {
 		defer wg.Done()
-		reader := bufio.NewReader(conn)
+		defer close(lost)
 		for {
-			message, err := reader.ReadString('\n')
-			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					// Normal disconnection
-					break
-				}
-				fmt.Printf("\nConnection lost: %v\n", err)
+			err := receive(sess, ui, files)
+			if sess.closed.Load() {
+				// Normal disconnection
+				break
+			}
+			fmt.Fprintf(out, "\nConnection lost: %v\n", err)
+			if !*reconnect || !sess.reconnect(dial, *maxBackoff) {
 				break
 			}
-			
-			// Print the message from the server
-				fmt.Print(message)
 		}
 	}()
 
@@ -64,16 +162,20 @@ func main() {
 	go func() {
 		defer wg.Done()
 		printHelp()
+		if ui != nil {
+			ui.run()
+			return
+		}
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			line := scanner.Text()
+
 			// Send command to server
-			_, err := conn.Write([]byte(line + "\n"))
-			if err != nil {
+			if err := submit(sess, files, line); err != nil {
 				fmt.Printf("Error sending message: %v\n", err)
 				break
 			}
-			
+
 			// Log user actions
 			if strings.HasPrefix(line, "/NICK ") || strings.HasPrefix(line, "/N ") {
 				nickname := strings.Split(line, " ")[1]
@@ -94,23 +196,1325 @@ func main() {
 	// Wait for interrupt signal or disconnect signal
 	select {
 	case <-sigCh:
-		fmt.Println("\nReceived interrupt signal")
+		fmt.Fprintln(out, "\nReceived interrupt signal")
+	case <-uiQuit:
+	case <-lost:
+	}
+
+	// Give the terminal back before printing anything else
+	if ui != nil {
+		ui.stop()
+		out = os.Stdout
 	}
 
-	// Close the connection
-	conn.Close()
+	// Close the connection, telling the server not to hold the nickname
+	sess.send("/QUIT")
+	sess.close()
 
 	// Wait for goroutines to finish
 	wg.Wait()
 	fmt.Println("Connection closed")
 }
 
+// out is where everything meant for the user is written, the screen when
+// the terminal UI is running
+var out io.Writer = os.Stdout
+
+// receive reads from the server until the connection fails, handing each
+// line to the terminal UI or printing it
+func receive(sess *session, ui *tui, files *transfers) error {
+	reader := bufio.NewReader(sess.current())
+	for {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		// Answer keepalive PINGs without bothering the user
+		if token, ok := pingToken(message); ok {
+			sess.write([]byte("PONG " + token + "\n"))
+			continue
+		}
+
+		// Resume tokens are kept for the next reconnect
+		if sess.observe(message) {
+			continue
+		}
+
+		if ui != nil {
+			ui.receive(message)
+			continue
+		}
+
+		// File transfers are handled here and reported in their own words
+		if files.handle(message) {
+			continue
+		}
+
+		// Messages that mention the user or their keywords come marked with "! "
+		if strings.HasPrefix(message, "! ") {
+			fmt.Fprint(out, "\a")
+		}
+
+		// Print the message from the server
+		fmt.Fprint(out, message)
+	}
+}
+
+// session sends commands to the server, as text lines or, once the terminal
+// UI has switched the connection to the JSON protocol, as request frames.
+// It outlives any one connection, carrying what is needed to get the same
+// nickname back after a reconnect.
+type session struct {
+	mu       sync.Mutex    // mutex to protect conn, token and nickname
+	conn     net.Conn      // Connection to the server, replaced on reconnect
+	token    string        // Resume token from the server, empty when resuming isn't possible
+	nickname string        // Last nickname asked for with /NICK
+	jsonMode atomic.Bool   // Commands are sent as JSON request frames
+	closed   atomic.Bool   // The user is leaving, connection errors are expected
+	done     chan struct{} // closed along with the session to stop reconnecting
+	stop     sync.Once     // closes done once
+}
+
+// current returns the connection in use
+func (s *session) current() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// write sends raw bytes on the current connection
+func (s *session) write(data []byte) error {
+	_, err := s.current().Write(data)
+	return err
+}
+
+// close ends the session for good
+func (s *session) close() {
+	s.closed.Store(true)
+	s.stop.Do(func() { close(s.done) })
+	s.current().Close()
+}
+
+// observe picks resume tokens out of the server's output and reports
+// whether the line was one, which the user doesn't need to see. When a
+// resume is refused it falls back to asking for the nickname again.
+func (s *session) observe(message string) bool {
+	message = strings.TrimRight(message, "\r\n")
+	var token string
+	failed := false
+	if strings.HasPrefix(message, "{") {
+		var f serverFrame
+		if json.Unmarshal([]byte(message), &f) != nil {
+			return false
+		}
+		if f.Type == "resume" {
+			token = f.Body
+		}
+		failed = f.Type == "reply" && f.Command == "RESUME" && f.Status >= 400
+	} else if rest, ok := strings.CutPrefix(message, "RESUME "); ok {
+		token = rest
+	} else {
+		failed = strings.HasPrefix(message, "Resume failed:")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token != "" {
+		s.token = token
+		return true
+	}
+	if failed {
+		s.token = ""
+		if s.nickname != "" {
+			go s.send("/NICK " + s.nickname)
+		}
+	}
+	return false
+}
+
+// reconnect redials the server with exponential backoff and jitter until it
+// succeeds or the session is closed, then asks for the old session back
+func (s *session) reconnect(dial func() (net.Conn, error), maxBackoff time.Duration) bool {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		// Jitter keeps clients dropped together from redialing together
+		wait := backoff/2 + rand.N(backoff/2+1)
+		fmt.Fprintf(out, "Reconnecting in %v (attempt %d)...\n", wait.Round(time.Millisecond), attempt)
+		select {
+		case <-s.done:
+			return false
+		case <-time.After(wait):
+		}
+
+		conn, err := dial()
+		if err != nil {
+			fmt.Fprintf(out, "Reconnect failed: %v\n", err)
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			return false
+		}
+		s.conn = conn
+		token, nickname := s.token, s.nickname
+		s.mu.Unlock()
+		fmt.Fprintf(out, "Reconnected to %s\n", conn.RemoteAddr())
+
+		// The new connection starts in the text protocol
+		if s.jsonMode.Load() {
+			s.write([]byte("/PROTO json\n"))
+		}
+		switch {
+		case token != "":
+			s.send("/RESUME " + token)
+		case nickname != "":
+			s.send("/NICK " + nickname)
+		}
+		return true
+	}
+}
+
+// send sends one command line
+func (s *session) send(line string) error {
+	return s.request("", line)
+}
+
+// request sends a command line with a request id, only JSON frames carry the id
+func (s *session) request(id, line string) error {
+	if !s.jsonMode.Load() {
+		return s.write([]byte(line + "\n"))
+	}
+
+	// The server joins the arguments with spaces, so the rest of the line is one argument
+	name, rest, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	req := map[string]any{"command": name}
+	if id != "" {
+		req["id"] = id
+	}
+	if rest != "" {
+		req["args"] = []string{rest}
+	}
+	data, _ := json.Marshal(req)
+	return s.write(append(data, '\n'))
+}
+
+// submit sends a line the user typed, expanding the commands the client handles itself
+func submit(sess *session, files *transfers, line string) error {
+	// "/SEND <nickname> <path>" offers a local file
+	if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "/SEND" {
+		command, err := files.offer(fields[1], fields[2])
+		if err != nil {
+			fmt.Fprintf(out, "Error sending file: %v\n", err)
+			return nil
+		}
+		line = command
+	}
+
+	// The server hangs up after /QUIT, which is no reason to reconnect
+	if line == "/QUIT" || strings.HasPrefix(line, "/QUIT ") {
+		sess.closed.Store(true)
+	}
+
+	// The nickname is asked for again after a reconnect if the session can't be resumed
+	if fields := strings.Fields(line); len(fields) >= 2 && (fields[0] == "/NICK" || fields[0] == "/N") {
+		sess.mu.Lock()
+		sess.nickname = fields[1]
+		sess.mu.Unlock()
+	}
+	return sess.send(line)
+}
+
+// isTerminal reports whether a file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty on the terminal, used to switch raw mode on and off
+// without platform specific ioctls
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// serverFrame is a line of the JSON protocol, a reply or an event
+type serverFrame struct {
+	Type    string         `json:"type"`
+	ID      string         `json:"id"`
+	Command string         `json:"command"`
+	Status  int            `json:"status"`
+	Message string         `json:"message"`
+	Data    map[string]any `json:"data"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Body    string         `json:"body"`
+	Time    time.Time      `json:"time"`
+	Offline bool           `json:"offline"`
+	Tags    []string       `json:"tags"`
+	Failed  []string       `json:"failed"`
+	File    *struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Data   string `json:"data"`
+		SHA256 string `json:"sha256"`
+	} `json:"file"`
+}
+
+// fileLine turns a transfer event back into the FILE line of the text protocol
+func (f serverFrame) fileLine() string {
+	switch f.Type {
+	case "file-offer":
+		return fmt.Sprintf("FILE OFFER %s %s %s %d", f.File.ID, f.From, f.File.Name, f.File.Size)
+	case "file-accepted":
+		return fmt.Sprintf("FILE ACCEPTED %s %s %s", f.File.ID, f.From, f.File.Name)
+	case "file-rejected":
+		return fmt.Sprintf("FILE REJECTED %s %s %s", f.File.ID, f.From, f.File.Name)
+	case "file-data":
+		return fmt.Sprintf("FILE DATA %s %s", f.File.ID, f.File.Data)
+	case "file-done":
+		return fmt.Sprintf("FILE DONE %s %s", f.File.ID, f.File.SHA256)
+	default:
+		return fmt.Sprintf("FILE ABORTED %s %s", f.File.ID, f.Body)
+	}
+}
+
+// scrollLine is a line of the scrollback
+type scrollLine struct {
+	text  string // Text without any colour
+	nick  string // Sender to colour within the text, if any
+	style string // SGR parameters applied to the whole line, if any
+}
+
+// usersID marks the /LIST requests the UI sends for tab completion
+const usersID = "tui-users"
+
+// readID marks the /READ requests the UI sends when you reply to someone
+const readID = "tui-read"
+
+// maxScrollback is how many lines the scrollback keeps
+const maxScrollback = 2000
+
+// tui is the full-screen terminal interface: a scrollback pane, a status
+// line and an input line that incoming messages never overwrite
+type tui struct {
+	mu    sync.Mutex
+	sess  *session   // Session commands are sent on
+	files *transfers // File transfers, fed the FILE events
+	quit  chan struct{}
+
+	saved   string // Terminal settings to restore
+	stopped bool   // The terminal has been given back
+	rows    int
+	cols    int
+
+	lines   []scrollLine // Scrollback, oldest first
+	partial string       // Line still being written, e.g. transfer progress
+	cr      bool         // A carriage return will restart the partial line
+	scroll  int          // Lines scrolled back from the newest
+
+	input   []rune   // Line being typed
+	cursor  int      // Position of the cursor in input
+	history []string // Lines entered, oldest first
+	histPos int      // Position in history while browsing it
+
+	nickname string         // Our nickname, learned from NICK replies
+	users    []string       // Nicknames for tab completion
+	listed   time.Time      // When users was last requested
+	unread   map[string]int // Unread direct messages by sender
+
+	matches []string // Completions being cycled through with tab
+	match   int      // Index of the completion last inserted
+	word    int      // Start in input of the word being completed
+}
+
+// newTUI switches the terminal to raw mode and takes over the screen
+func newTUI(sess *session, files *transfers) (*tui, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+
+	t := &tui{sess: sess, files: files, quit: make(chan struct{}), saved: saved, unread: make(map[string]int)}
+	t.resize()
+	os.Stdout.WriteString("\x1b[?1049h") // alternate screen
+
+	// Redraw when the terminal is resized
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			t.resize()
+			t.draw()
+		}
+	}()
+	t.draw()
+	return t, nil
+}
+
+// stop restores the terminal
+func (t *tui) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.stopped {
+		t.stopped = true
+		os.Stdout.WriteString("\x1b[?1049l")
+		stty(t.saved)
+	}
+}
+
+// resize reads the size of the terminal
+func (t *tui) resize() {
+	rows, cols := 24, 80
+	if size, err := stty("size"); err == nil {
+		var r, c int
+		if fmt.Sscan(size, &r, &c); r > 0 && c > 0 {
+			rows, cols = r, c
+		}
+	}
+	t.mu.Lock()
+	t.rows, t.cols = rows, cols
+	t.mu.Unlock()
+}
+
+// fetchUsers asks the server for the nicknames used by tab completion
+func (t *tui) fetchUsers() {
+	t.mu.Lock()
+	t.listed = time.Now()
+	t.mu.Unlock()
+	t.sess.request(usersID, "/LIST")
+}
+
+// Write adds output to the scrollback, a carriage return restarts the current line
+func (t *tui) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	for _, r := range string(p) {
+		switch r {
+		case '\r':
+			t.cr = true
+		case '\n':
+			t.addLine(scrollLine{text: t.partial})
+			t.partial, t.cr = "", false
+		default:
+			if t.cr {
+				t.partial, t.cr = "", false
+			}
+			t.partial += string(r)
+		}
+	}
+	t.mu.Unlock()
+	t.draw()
+	return len(p), nil
+}
+
+// addLine appends to the scrollback, keeping the view still if scrolled back
+func (t *tui) addLine(line scrollLine) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > maxScrollback {
+		t.lines = t.lines[len(t.lines)-maxScrollback:]
+	}
+	if t.scroll > 0 {
+		t.scroll = min(t.scroll+1, len(t.lines)-1)
+	}
+}
+
+// show adds lines to the scrollback and redraws
+func (t *tui) show(lines ...scrollLine) {
+	t.mu.Lock()
+	for _, line := range lines {
+		t.addLine(line)
+	}
+	t.mu.Unlock()
+	t.draw()
+}
+
+// receive handles a line from the server
+func (t *tui) receive(message string) {
+	message = strings.TrimRight(message, "\r\n")
+	var f serverFrame
+	if !strings.HasPrefix(message, "{") || json.Unmarshal([]byte(message), &f) != nil {
+		// Text sent before the switch to JSON, such as the welcome message
+		t.show(scrollLine{text: message})
+		return
+	}
+
+	switch {
+	case f.Type == "reply":
+		if f.Command == "LIST" && f.Data["users"] != nil {
+			t.setUsers(f.Data["users"])
+			if f.ID == usersID {
+				return
+			}
+		}
+		if f.ID == readID {
+			return
+		}
+		if nick, ok := f.Data["nickname"].(string); ok && (f.Command == "NICK" || f.Command == "N" || f.Command == "IDENTIFY" || f.Command == "RESUME") {
+			t.mu.Lock()
+			t.nickname = nick
+			t.mu.Unlock()
+		}
+		var lines []scrollLine
+		for _, text := range strings.Split(f.Message, "\r\n") {
+			line := scrollLine{text: text}
+			if f.Status >= 400 {
+				line.style = "31" // red
+			}
+			lines = append(lines, line)
+		}
+		t.show(lines...)
+	case f.Type == "message":
+		line := scrollLine{nick: f.From}
+		switch {
+		case f.Offline:
+			line.text = fmt.Sprintf("[DM] %s (offline, %s): %s", f.From, f.Time.Local().Format(time.DateTime), f.Body)
+		case strings.HasPrefix(f.To, "#"):
+			line.text = fmt.Sprintf("[%s] %s: %s", f.To, f.From, f.Body)
+		case f.To == "*":
+			line.text = fmt.Sprintf("%s: %s", f.From, f.Body)
+		default:
+			line.text = fmt.Sprintf("[DM] %s: %s", f.From, f.Body)
+			line.style = "1" // bold
+		}
+		if len(f.Tags) > 0 {
+			// Mentions and keywords stand out, and ring the terminal bell
+			line.text = "! " + line.text + " <" + strings.Join(f.Tags, ", ") + ">"
+			line.style = "1;35" // bold magenta
+		}
+		t.mu.Lock()
+		if len(f.Tags) > 0 {
+			// Written under t.mu so the bell can't land inside a redraw
+			os.Stdout.WriteString("\a")
+		}
+		if f.Offline || (f.To != "*" && !strings.HasPrefix(f.To, "#")) {
+			t.unread[f.From]++
+		}
+		if !f.Offline && !slices.Contains(t.users, f.From) {
+			// Senders can be completed before the next /LIST
+			t.users = append(t.users, f.From)
+		}
+		t.mu.Unlock()
+		t.show(line)
+	case f.Type == "delivered":
+		t.show(scrollLine{text: fmt.Sprintf("(delivered to %s)", f.From), style: "90"})
+	case f.Type == "read":
+		t.show(scrollLine{text: fmt.Sprintf("(read by %s)", f.From), style: "90"})
+	case strings.HasPrefix(f.Type, "file-") && f.File != nil:
+		t.files.handle(f.fileLine())
+	default:
+		t.show(scrollLine{text: f.Body, style: "33"}) // notices in yellow
+	}
+}
+
+// setUsers replaces the nicknames used by tab completion
+func (t *tui) setUsers(list any) {
+	items, _ := list.([]any)
+	users := make([]string, 0, len(items))
+	for _, item := range items {
+		if nick, ok := item.(string); ok {
+			users = append(users, nick)
+		}
+	}
+	t.mu.Lock()
+	t.users = users
+	t.mu.Unlock()
+}
+
+// run reads keys until the user quits
+func (t *tui) run() {
+	defer close(t.quit)
+	t.show(scrollLine{text: "Tab completes nicknames, Up/Down browse your history, PgUp/PgDn scroll, Ctrl-C quits", style: "90"})
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+
+		var line string
+		var entered bool
+		t.mu.Lock()
+		completing := false
+		switch r {
+		case 3, 4: // Ctrl-C, Ctrl-D
+			t.mu.Unlock()
+			return
+		case '\r', '\n':
+			line, entered = t.enter()
+		case '\t':
+			completing = true
+			t.complete()
+		case 127, 8: // Backspace
+			if t.cursor > 0 {
+				t.input = slices.Delete(t.input, t.cursor-1, t.cursor)
+				t.cursor--
+			}
+		case 1: // Ctrl-A
+			t.cursor = 0
+		case 5: // Ctrl-E
+			t.cursor = len(t.input)
+		case 21: // Ctrl-U
+			t.input, t.cursor = nil, 0
+		case 12: // Ctrl-L, the redraw below is all it takes
+		case 27:
+			t.mu.Unlock()
+			seq := readEscape(reader)
+			t.mu.Lock()
+			t.key(seq)
+		default:
+			if r >= ' ' {
+				t.input = slices.Insert(t.input, t.cursor, r)
+				t.cursor++
+			}
+		}
+		if !completing {
+			t.matches = nil
+		}
+		t.mu.Unlock()
+
+		if entered {
+			t.send(line)
+		}
+		t.draw()
+	}
+}
+
+// readEscape reads the rest of an escape sequence, e.g. "[A" for the up arrow
+func readEscape(reader *bufio.Reader) string {
+	r, _, err := reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	seq := string(r)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return seq
+		}
+		seq += string(r)
+		if r >= '@' && r <= '~' {
+			return seq
+		}
+	}
+}
+
+// key handles an escape sequence, the caller must hold t.mu
+func (t *tui) key(seq string) {
+	height := t.rows - 2
+	switch seq {
+	case "[A": // Up, older history
+		if t.histPos > 0 {
+			t.histPos--
+			t.input = []rune(t.history[t.histPos])
+			t.cursor = len(t.input)
+		}
+	case "[B": // Down, newer history
+		if t.histPos < len(t.history) {
+			t.histPos++
+			t.input = nil
+			if t.histPos < len(t.history) {
+				t.input = []rune(t.history[t.histPos])
+			}
+			t.cursor = len(t.input)
+		}
+	case "[C":
+		t.cursor = min(t.cursor+1, len(t.input))
+	case "[D":
+		t.cursor = max(t.cursor-1, 0)
+	case "[H", "OH", "[1~", "[7~":
+		t.cursor = 0
+	case "[F", "OF", "[4~", "[8~":
+		t.cursor = len(t.input)
+	case "[3~": // Delete
+		if t.cursor < len(t.input) {
+			t.input = slices.Delete(t.input, t.cursor, t.cursor+1)
+		}
+	case "[5~": // Page Up
+		t.scroll = min(t.scroll+height-1, max(len(t.lines)-1, 0))
+	case "[6~": // Page Down
+		t.scroll = max(t.scroll-(height-1), 0)
+	}
+}
+
+// enter takes the typed line, the caller must hold t.mu
+func (t *tui) enter() (string, bool) {
+	line := string(t.input)
+	t.input, t.cursor = nil, 0
+	if strings.TrimSpace(line) == "" {
+		return "", false
+	}
+	t.history = append(t.history, line)
+	t.histPos = len(t.history)
+	t.scroll = 0
+
+	// Replying to someone reads their direct messages, which they are told about
+	if fields := strings.Fields(line); len(fields) > 1 && (fields[0] == "/MSG" || fields[0] == "/M") {
+		for _, nick := range strings.Split(fields[1], ",") {
+			if t.unread[nick] > 0 {
+				go t.sess.request(readID, "/READ "+nick)
+			}
+			delete(t.unread, nick)
+		}
+	}
+	return line, true
+}
+
+// send echoes a typed line and sends it to the server
+func (t *tui) send(line string) {
+	t.show(scrollLine{text: "> " + line, style: "90"}) // grey
+	if err := submit(t.sess, t.files, line); err != nil {
+		fmt.Fprintf(out, "Error sending message: %v\n", err)
+	}
+}
+
+// complete completes the nickname before the cursor, cycling through the
+// matches when tab is pressed again, the caller must hold t.mu
+func (t *tui) complete() {
+	if t.matches == nil {
+		t.word = t.cursor
+		for t.word > 0 && t.input[t.word-1] != ' ' && t.input[t.word-1] != ',' {
+			t.word--
+		}
+		prefix := strings.ToLower(string(t.input[t.word:t.cursor]))
+		for _, nick := range t.users {
+			if strings.HasPrefix(strings.ToLower(nick), prefix) && nick != t.nickname {
+				t.matches = append(t.matches, nick)
+			}
+		}
+		t.match = -1
+
+		// Keep the list fresh for the next time, the reply arrives in the background
+		if stale := time.Since(t.listed); stale > 10*time.Second || (len(t.matches) == 0 && stale > time.Second) {
+			t.listed = time.Now()
+			go t.sess.request(usersID, "/LIST")
+		}
+		if len(t.matches) == 0 {
+			t.matches = nil
+			return
+		}
+	}
+
+	t.match = (t.match + 1) % len(t.matches)
+	completion := []rune(t.matches[t.match] + " ")
+	t.input = append(t.input[:t.word:t.word], append(completion, t.input[t.cursor:]...)...)
+	t.cursor = t.word + len(completion)
+}
+
+// draw redraws the whole screen
+func (t *tui) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped || t.rows < 3 || t.cols < 10 {
+		return
+	}
+	height := t.rows - 2
+
+	// Gather screen rows from the newest visible line upwards, wrapping long lines
+	var rows []string
+	end := len(t.lines) - t.scroll
+	if t.scroll == 0 && t.partial != "" {
+		rows = t.wrap(scrollLine{text: t.partial})
+	}
+	for i := end - 1; i >= 0 && len(rows) < height; i-- {
+		rows = append(t.wrap(t.lines[i]), rows...)
+	}
+	if len(rows) > height {
+		rows = rows[len(rows)-height:]
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	for i := 0; i < height; i++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", i+1)
+		if offset := height - len(rows); i >= offset {
+			b.WriteString(rows[i-offset])
+		}
+		b.WriteString("\x1b[K")
+	}
+
+	// Status line: nickname, unread direct messages and scroll position
+	status := " " + t.nickname
+	if t.nickname == "" {
+		status = " (no nickname)"
+	}
+	if len(t.unread) > 0 {
+		senders := make([]string, 0, len(t.unread))
+		for nick, n := range t.unread {
+			senders = append(senders, fmt.Sprintf("%s(%d)", nick, n))
+		}
+		sort.Strings(senders)
+		status += " | DM: " + strings.Join(senders, " ")
+	}
+	if t.scroll > 0 {
+		status += fmt.Sprintf(" | scrolled back %d lines, PgDn to return", t.scroll)
+	}
+	statusRunes := []rune(status)
+	if len(statusRunes) > t.cols {
+		statusRunes = statusRunes[:t.cols]
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s%s\x1b[0m", height+1, string(statusRunes), strings.Repeat(" ", t.cols-len(statusRunes)))
+
+	// Input line after the "> " prompt, scrolled sideways to keep the cursor visible
+	width := t.cols - 2
+	offset := max(t.cursor-(width-1), 0)
+	visible := t.input[offset:min(offset+width, len(t.input))]
+	fmt.Fprintf(&b, "\x1b[%d;1H> %s\x1b[K", t.rows, string(visible))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", t.rows, 3+t.cursor-offset)
+	os.Stdout.WriteString(b.String())
+}
+
+// wrap splits a scrollback line into screen rows, colouring the sender on the first
+func (t *tui) wrap(line scrollLine) []string {
+	text := []rune(line.text)
+	var rows []string
+	for len(text) > t.cols {
+		rows = append(rows, string(text[:t.cols]))
+		text = text[t.cols:]
+	}
+	rows = append(rows, string(text))
+
+	if line.nick != "" {
+		i := strings.Index(rows[0], line.nick+":")
+		if i < 0 {
+			i = strings.Index(rows[0], line.nick+" (")
+		}
+		if i >= 0 {
+			// Resume the line's own style after the sender
+			reset := "\x1b[0m"
+			if line.style != "" {
+				reset = "\x1b[0;" + line.style + "m"
+			}
+			rows[0] = rows[0][:i] + fmt.Sprintf("\x1b[%dm", nickColour(line.nick)) + line.nick + reset + rows[0][i+len(line.nick):]
+		}
+	}
+	if line.style != "" {
+		for i := range rows {
+			rows[i] = "\x1b[" + line.style + "m" + rows[i] + "\x1b[0m"
+		}
+	}
+	return rows
+}
+
+// nickColour picks a stable colour for a nickname among red, green, yellow, blue, magenta and cyan
+func nickColour(nick string) int {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return 31 + int(h.Sum32()%6)
+}
+
+// isFlagSet reports whether a flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// clientTLSConfig builds the TLS configuration used to dial the server
+func clientTLSConfig(host, caFile string, insecure bool, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		// Pin the CA: only certificates it signed are trusted
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// pingToken returns the token of a PING from the server, in either the
+// text or the JSON protocol
+func pingToken(message string) (string, bool) {
+	message = strings.TrimSpace(message)
+	if token, ok := strings.CutPrefix(message, "PING "); ok {
+		return token, true
+	}
+	if strings.HasPrefix(message, "{") {
+		var event struct {
+			Type string `json:"type"`
+			Body string `json:"body"`
+		}
+		if json.Unmarshal([]byte(message), &event) == nil && event.Type == "ping" {
+			return event.Body, true
+		}
+	}
+	return "", false
+}
+
+// fileChunkSize is how much of a file goes into each /CHUNK line
+const fileChunkSize = 16 * 1024
+
+// download is a file being received from another user
+type download struct {
+	from     string    // Sender nickname
+	name     string    // File name offered by the sender
+	size     int64     // Size announced by the sender
+	received int64     // Bytes written so far
+	path     string    // Where the file is saved, empty until the first chunk
+	file     *os.File  // File being written
+	hash     hash.Hash // SHA-256 of the bytes written so far
+}
+
+// transfers tracks the files this client is sending and receiving
+type transfers struct {
+	mu        sync.Mutex
+	sess      *session             // Session chunks are sent on
+	dir       string               // Directory downloads are saved in
+	outgoing  map[string]string    // Local paths of offered files by "nickname filename"
+	downloads map[string]*download // Offered and running downloads by transfer id
+}
+
+// newTransfers creates the transfer state of a connection
+func newTransfers(sess *session, dir string) *transfers {
+	return &transfers{sess: sess, dir: dir, outgoing: make(map[string]string), downloads: make(map[string]*download)}
+}
+
+// offer turns "/SEND <nickname> <path>" into the server's "/SEND <nickname> <filename> <size>",
+// remembering the path for when the recipient accepts
+func (t *transfers) offer(nickname, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	name := strings.ReplaceAll(filepath.Base(path), " ", "_")
+
+	t.mu.Lock()
+	t.outgoing[nickname+" "+name] = path
+	t.mu.Unlock()
+	return fmt.Sprintf("/SEND %s %s %d", nickname, name, info.Size()), nil
+}
+
+// handle processes a FILE line from the server, returning false for any other line
+func (t *transfers) handle(message string) bool {
+	fields := strings.Fields(message)
+	if len(fields) < 3 || fields[0] != "FILE" {
+		return false
+	}
+	id := fields[2]
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch fields[1] {
+	case "OFFER":
+		// FILE OFFER <id> <from> <name> <size> ...
+		if len(fields) < 6 {
+			return false
+		}
+		size, _ := strconv.ParseInt(fields[5], 10, 64)
+		t.downloads[id] = &download{from: fields[3], name: fields[4], size: size}
+		fmt.Fprintf(out, "%s wants to send you %s (%d bytes). Type /ACCEPT %s or /REJECT %s\n", fields[3], fields[4], size, id, id)
+	case "ACCEPTED", "REJECTED":
+		// FILE ACCEPTED|REJECTED <id> <nickname> <name>
+		if len(fields) < 5 {
+			return false
+		}
+		key := fields[3] + " " + fields[4]
+		path, exists := t.outgoing[key]
+		delete(t.outgoing, key)
+		if fields[1] == "REJECTED" {
+			fmt.Fprintf(out, "%s rejected %s\n", fields[3], fields[4])
+		} else if exists {
+			fmt.Fprintf(out, "%s accepted %s, sending\n", fields[3], fields[4])
+			go t.send(id, path)
+		}
+	case "DATA":
+		if d := t.downloads[id]; d != nil && len(fields) == 4 {
+			if err := t.write(d, fields[3]); err != nil {
+				fmt.Fprintf(out, "\nError saving %s: %v\n", d.name, err)
+				t.discard(id)
+			}
+		}
+	case "DONE":
+		if d := t.downloads[id]; d != nil && len(fields) == 4 {
+			t.finish(id, d, fields[3])
+		}
+	case "ABORTED":
+		fmt.Fprintf(out, "\nTransfer %s aborted: %s\n", id, strings.Join(fields[3:], " "))
+		t.discard(id)
+	default:
+		return false
+	}
+	return true
+}
+
+// write saves the next chunk of a download, creating the file on the first one
+func (t *transfers) write(d *download, chunk string) error {
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil {
+		return err
+	}
+	if d.file == nil {
+		if err := os.MkdirAll(t.dir, 0755); err != nil {
+			return err
+		}
+		if d.file, d.path, err = createUnique(t.dir, filepath.Base(d.name)); err != nil {
+			return err
+		}
+		d.hash = sha256.New()
+	}
+	if _, err := d.file.Write(data); err != nil {
+		return err
+	}
+	d.hash.Write(data)
+	d.received += int64(len(data))
+	printProgress("Receiving", d.name, d.received, d.size)
+	return nil
+}
+
+// finish closes a download and checks it against the sender's checksum
+func (t *transfers) finish(id string, d *download, checksum string) {
+	delete(t.downloads, id)
+	if d.file == nil {
+		fmt.Fprintf(out, "\nTransfer %s of %s ended without data\n", id, d.name)
+		return
+	}
+	d.file.Close()
+
+	sum := hex.EncodeToString(d.hash.Sum(nil))
+	if d.received != d.size || sum != checksum {
+		os.Remove(d.path)
+		fmt.Fprintf(out, "\nDownload of %s failed verification, discarded\n", d.name)
+		return
+	}
+	fmt.Fprintf(out, "\nSaved %s from %s to %s (sha256 %s)\n", d.name, d.from, d.path, sum)
+}
+
+// discard drops a download and whatever was saved of it
+func (t *transfers) discard(id string) {
+	d := t.downloads[id]
+	delete(t.downloads, id)
+	if d != nil && d.file != nil {
+		d.file.Close()
+		os.Remove(d.path)
+	}
+}
+
+// send streams an accepted file to the server in chunks, then its checksum
+func (t *transfers) send(id, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(out, "Error opening %s: %v\n", path, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintf(out, "Error reading %s: %v\n", path, err)
+		return
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, fileChunkSize)
+	var sent int64
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			line := fmt.Sprintf("/CHUNK %s %s", id, base64.StdEncoding.EncodeToString(buf[:n]))
+			if err := t.sess.send(line); err != nil {
+				fmt.Fprintf(out, "\nError sending %s: %v\n", path, err)
+				return
+			}
+			sent += int64(n)
+			printProgress("Sending", filepath.Base(path), sent, info.Size())
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintf(out, "\nError reading %s: %v\n", path, err)
+			break
+		}
+	}
+
+	// A short or failed read shows up as a checksum mismatch and aborts the transfer
+	t.sess.send(fmt.Sprintf("/DONE %s %s", id, hex.EncodeToString(hash.Sum(nil))))
+	fmt.Fprintln(out)
+}
+
+// createUnique creates a new file in dir, numbering the name if it is taken
+func createUnique(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return file, path, err
+		}
+	}
+}
+
+// printProgress redraws a transfer's progress on the current line
+func printProgress(verb, name string, done, total int64) {
+	percent := int64(100)
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	fmt.Fprintf(out, "\r%s %s: %d/%d bytes (%d%%)", verb, name, done, total, percent)
+}
+
 // printHelp prints the available commands to the user
 func printHelp() {
-	fmt.Println("Available Commands:")
-	fmt.Println("  /NICK <nickname>, /N <nickname> - Set or change your nickname")
-	fmt.Println("  /LIST, /L                       - List all connected users")
-	fmt.Println("  /MSG <user> <message>, /M <user> <message> - Send a private message")
-	fmt.Println("  /MSG * <message>, /M * <message>           - Send a message to all users")
-	fmt.Println("-------------------")
-}
\ No newline at end of file
+	fmt.Fprintln(out, "Available Commands:")
+	fmt.Fprintln(out, "  /NICK <nickname>, /N <nickname> - Set or change your nickname")
+	fmt.Fprintln(out, "  /LIST, /L                       - List all connected users")
+	fmt.Fprintln(out, "  /MSG <user> <message>, /M <user> <message> - Send a private message")
+	fmt.Fprintln(out, "  /MSG * <message>, /M * <message>           - Send a message to all users")
+	fmt.Fprintln(out, "  /MSG #room <message>                       - Send a message to a room")
+	fmt.Fprintln(out, "  /READ <id|nickname>             - Let senders know you read their messages")
+	fmt.Fprintln(out, "  /HIGHLIGHT [add|del <keyword>]  - Ring the bell for a keyword as well as @mentions of you")
+	fmt.Fprintln(out, "  /JOIN #room, /PART #room        - Join or leave a room")
+	fmt.Fprintln(out, "  /TOPIC #room [topic]            - Show or set a room topic")
+	fmt.Fprintln(out, "  /LIST #room                     - List the members of a room")
+	fmt.Fprintln(out, "  /REGISTER <password>            - Register your current nickname")
+	fmt.Fprintln(out, "  /IDENTIFY <nickname> <password> - Log in to a registered nickname")
+	fmt.Fprintln(out, "  /HISTORY <nickname|#room|*> [n] - Show your last n messages")
+	fmt.Fprintln(out, "  /STATS [nickname]               - Show delivery counters")
+	fmt.Fprintln(out, "  /PROTO json|text                - Switch between JSON frames and plain text")
+	fmt.Fprintln(out, "  /AWAY [message], /BACK          - Mark yourself as away or back")
+	fmt.Fprintln(out, "  /WHOIS <nickname>               - Show a user's presence and idle time")
+	fmt.Fprintln(out, "  /IGNORE <nick>, /UNIGNORE <nick> - Stop or resume receiving a user's messages")
+	fmt.Fprintln(out, "  /IGNORES                        - List the users you are ignoring")
+	fmt.Fprintln(out, "  /SEND <nickname> <path>         - Offer a file to a user")
+	fmt.Fprintln(out, "  /ACCEPT <id>, /REJECT <id>      - Answer a file offer, accepted files go to -download-dir")
+	fmt.Fprintln(out, "  /HELP [command]                 - Ask the server about its commands")
+	fmt.Fprintln(out, "  /QUIT                           - Leave the chat, the client reconnects after any other disconnect")
+	fmt.Fprintln(out, "Operator Commands:")
+	fmt.Fprintln(out, "  /KICK <nick> [reason]           - Disconnect a user")
+	fmt.Fprintln(out, "  /BAN <nick|ip> [duration] [reason] - Ban a nickname or address, for good without a duration")
+	fmt.Fprintln(out, "  /UNBAN <nick|ip>                - Lift a ban")
+	fmt.Fprintln(out, "  /MUTE <nick> [duration], /UNMUTE <nick> - Stop or allow a user's messages")
+	fmt.Fprintln(out, "  /FILTER <reject|redact|flag> <regexp>, /UNFILTER <regexp> - Add or remove a message filter")
+	fmt.Fprintln(out, "  /FILTERS                        - List the message filters")
+	fmt.Fprintln(out, "  /OP <nick>                      - Make a user an operator for their session")
+	fmt.Fprintln(out, "-------------------")
+}
+
+// batch sends messages for a script, a cron job or a CI pipeline. It
+// speaks the JSON protocol so that each reply can be matched to its
+// request and checked.
+type batch struct {
+	sess    *session
+	frames  chan serverFrame // Frames from the server, closed when the connection ends
+	timeout time.Duration    // How long to wait for a reply
+	show    bool             // Print incoming messages
+	nextID  int
+
+	// After being rate limited, messages are spaced out so the server
+	// doesn't count a violation for each one
+	pace time.Duration
+	sent time.Time
+}
+
+// runBatch registers nick, identifying with password unless it is empty,
+// sends message to the recipients, or every line of stdin when message is
+// empty, and prints incoming messages for wait afterwards. It returns the
+// exit status: 0 when everything was delivered, 1 when registration or
+// any message failed.
+func runBatch(conn net.Conn, nick, password, recipients, message string, timeout, wait time.Duration) int {
+	b := &batch{
+		sess:    &session{conn: conn, done: make(chan struct{})},
+		frames:  make(chan serverFrame, 64),
+		timeout: timeout,
+		show:    wait > 0,
+	}
+	defer b.sess.close()
+	go b.read()
+
+	b.sess.send("/PROTO json")
+	b.sess.jsonMode.Store(true)
+	if _, err := b.await("", "PROTO"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error switching to JSON: %v\n", err)
+		return 1
+	}
+	// A registered nickname is reserved for whoever identifies as it
+	register := "/NICK " + nick
+	if password != "" {
+		register = "/IDENTIFY " + nick + " " + password
+	}
+	if _, err := b.call(register); err != nil {
+		fmt.Fprintf(os.Stderr, "Registration failed: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	send := func(text string) bool {
+		err := b.send(recipients, text)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Message not delivered: %v\n", err)
+			status = 1
+		}
+		// A lost connection fails everything after it too
+		return !errors.Is(err, errConnectionLost)
+	}
+	if message != "" {
+		send(message)
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if text := strings.TrimSpace(scanner.Text()); text != "" && !send(text) {
+				return 1
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading from stdin: %v\n", err)
+			status = 1
+		}
+	}
+
+	// Collect replies until the time is up or the server hangs up
+	deadline := time.After(wait)
+	for waiting := wait > 0; waiting; {
+		select {
+		case f, ok := <-b.frames:
+			if !ok {
+				waiting = false
+			} else {
+				b.print(f)
+			}
+		case <-deadline:
+			waiting = false
+		}
+	}
+
+	b.sess.send("/QUIT")
+	return status
+}
+
+// errConnectionLost is returned by a batch once the server has gone away
+var errConnectionLost = errors.New("connection lost")
+
+// read passes the server's JSON frames to b.frames, answering pings itself
+func (b *batch) read() {
+	defer close(b.frames)
+	reader := bufio.NewReader(b.sess.current())
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if token, ok := pingToken(line); ok {
+			b.sess.write([]byte("PONG " + token + "\n"))
+			continue
+		}
+		// The greeting arrives as text before the switch to JSON
+		var f serverFrame
+		if json.Unmarshal([]byte(line), &f) == nil {
+			b.frames <- f
+		}
+	}
+}
+
+// call sends a command and waits for its reply, which is an error when
+// the command failed
+func (b *batch) call(line string) (serverFrame, error) {
+	b.nextID++
+	id := "batch-" + strconv.Itoa(b.nextID)
+	if err := b.sess.request(id, line); err != nil {
+		return serverFrame{}, errConnectionLost
+	}
+	f, err := b.await(id, commandOf(line))
+	if err == nil && f.Status >= 400 {
+		err = fmt.Errorf("%d %s", f.Status, f.Message)
+	}
+	return f, err
+}
+
+// send sends one message, slowing down to the rate the server allows
+func (b *batch) send(recipients, text string) error {
+	for {
+		time.Sleep(time.Until(b.sent.Add(b.pace)))
+		b.sent = time.Now()
+		f, err := b.call("/MSG " + recipients + " " + text)
+		if f.Status == 429 {
+			if seconds, ok := f.Data["retry_after"].(float64); ok {
+				// A little over the wait, the bucket refills while the reply travels
+				b.pace = max(b.pace, time.Duration(seconds*1.1*float64(time.Second))+10*time.Millisecond)
+				continue
+			}
+		}
+		if err == nil && len(f.Failed) > 0 {
+			err = fmt.Errorf("%s could not be reached", strings.Join(f.Failed, ", "))
+		}
+		return err
+	}
+}
+
+// await waits for the reply to a request, printing messages that arrive meanwhile
+func (b *batch) await(id, command string) (serverFrame, error) {
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case f, ok := <-b.frames:
+			if !ok {
+				return serverFrame{}, errConnectionLost
+			}
+			if f.Type == "reply" && f.ID == id && f.Command == command {
+				return f, nil
+			}
+			b.print(f)
+		case <-timer.C:
+			return serverFrame{}, fmt.Errorf("no reply to %s within %v", command, b.timeout)
+		}
+	}
+}
+
+// print shows an incoming message when the script asked to see replies
+func (b *batch) print(f serverFrame) {
+	if !b.show || f.Type != "message" {
+		return
+	}
+	if strings.HasPrefix(f.To, "#") {
+		fmt.Fprintf(out, "[%s] %s: %s\n", f.To, f.From, f.Body)
+	} else {
+		fmt.Fprintf(out, "%s: %s\n", f.From, f.Body)
+	}
+}
+
+// commandOf returns the name of a command line without its slash, e.g. MSG
+func commandOf(line string) string {
+	name, _, _ := strings.Cut(line, " ")
+	return strings.ToUpper(strings.TrimPrefix(name, "/"))
+}
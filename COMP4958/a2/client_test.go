@@ -0,0 +1,230 @@
+//go:build ignore
+
+// Tests for the client, run with go test client.go client_test.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTUI creates an interface with no terminal and no server, whose
+// users were listed just now
+func newTestTUI(nickname string, users ...string) *tui {
+	return &tui{nickname: nickname, users: users, listed: time.Now(), unread: make(map[string]int)}
+}
+
+func TestTabCompletion(t *testing.T) {
+	ui := newTestTUI("albert", "alice", "albert", "Alfred", "bob")
+	typeLine(ui, "/MSG bob,al")
+
+	// Matches cycle in the order they were listed, without our own nickname
+	for _, want := range []string{"/MSG bob,alice ", "/MSG bob,Alfred ", "/MSG bob,alice "} {
+		ui.complete()
+		if got := string(ui.input); got != want || ui.cursor != len(ui.input) {
+			t.Errorf("after tab: %q with the cursor at %d, want %q", got, ui.cursor, want)
+		}
+	}
+
+	// Text after the cursor stays where it is
+	ui.matches = nil
+	typeLine(ui, "hi b there")
+	ui.cursor = len("hi b")
+	ui.complete()
+	if got := string(ui.input); got != "hi bob  there" || ui.cursor != len("hi bob ") {
+		t.Errorf("completing mid-line gave %q with the cursor at %d", got, ui.cursor)
+	}
+
+	ui.matches = nil
+	typeLine(ui, "/MSG zed")
+	ui.complete()
+	if got := string(ui.input); got != "/MSG zed" {
+		t.Errorf("completing a prefix nobody has gave %q", got)
+	}
+}
+
+// typeLine replaces the input line, leaving the cursor at its end
+func typeLine(ui *tui, line string) {
+	ui.input = []rune(line)
+	ui.cursor = len(ui.input)
+}
+
+func TestScrollback(t *testing.T) {
+	ui := newTestTUI("alice")
+
+	// A carriage return restarts the line, as progress output does
+	ui.Write([]byte("sending 10%\rsending 50%\rsent\nnext"))
+	if len(ui.lines) != 1 || ui.lines[0].text != "sent" || ui.partial != "next" {
+		t.Errorf("lines %+v, partial %q", ui.lines, ui.partial)
+	}
+
+	// New lines don't move the view while scrolled back
+	ui.show(scrollLine{text: "one"}, scrollLine{text: "two"})
+	ui.scroll = 1
+	ui.addLine(scrollLine{text: "later"})
+	if ui.scroll != 2 {
+		t.Errorf("scroll = %d after a new line, want 2", ui.scroll)
+	}
+
+	for i := 0; i < maxScrollback+10; i++ {
+		ui.addLine(scrollLine{text: "spam"})
+	}
+	if len(ui.lines) != maxScrollback || ui.scroll > len(ui.lines)-1 {
+		t.Errorf("%d lines scrolled back %d, want at most %d lines", len(ui.lines), ui.scroll, maxScrollback)
+	}
+}
+
+func TestWrapColoursTheSender(t *testing.T) {
+	ui := newTestTUI("alice")
+	ui.cols = 10
+
+	rows := ui.wrap(scrollLine{text: "bob: hello there", nick: "bob", style: "1"})
+	if len(rows) != 2 {
+		t.Fatalf("wrapped into %q", rows)
+	}
+	if want := fmt.Sprintf("\x1b[1m\x1b[%dmbob\x1b[0;1m: hello\x1b[0m", nickColour("bob")); rows[0] != want {
+		t.Errorf("first row %q, want %q", rows[0], want)
+	}
+	if want := "\x1b[1m there\x1b[0m"; rows[1] != want {
+		t.Errorf("second row %q, want %q", rows[1], want)
+	}
+	if strings.Count(strings.Join(rows, ""), "bob") != 1 {
+		t.Errorf("the sender appears more than once in %q", rows)
+	}
+}
+
+func TestObserveResumeTokens(t *testing.T) {
+	conn, server := net.Pipe()
+	defer conn.Close()
+	defer server.Close()
+	sess := &session{conn: conn, nickname: "alice", done: make(chan struct{})}
+
+	for _, line := range []string{"RESUME abc\r\n", `{"type": "resume", "body": "def", "time": "2026-01-02T03:04:05Z"}`} {
+		if !sess.observe(line) {
+			t.Errorf("%q was shown to the user", line)
+		}
+	}
+	if sess.token != "def" {
+		t.Errorf("token = %q, want the latest", sess.token)
+	}
+	if sess.observe("alice: RESUME is a word too\r\n") || sess.token != "def" {
+		t.Error("a chat message was taken for a token")
+	}
+
+	// A refused resume forgets the token and asks for the nickname instead
+	if sess.observe("Resume failed: unknown or expired token\r\n") {
+		t.Error("the failure was hidden from the user")
+	}
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil || line != "/NICK alice\n" || sess.token != "" {
+		t.Errorf("after a failed resume: sent %q (%v), token %q", line, err, sess.token)
+	}
+}
+
+// fakeServer answers a batch on the other end of the returned connection.
+// Each request gets the next reply listed for its command, with the
+// request's id; a command with no replies left closes the connection.
+// Events queued in after go out once the reply to their command is sent.
+func fakeServer(t *testing.T, replies map[string][]serverFrame, after map[string][]string) (net.Conn, func() []string) {
+	t.Helper()
+	conn, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	var requests []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID      string   `json:"id"`
+				Command string   `json:"command"`
+				Args    []string `json:"args"`
+			}
+			if line == "/PROTO json\n" {
+				req.Command = "PROTO"
+			} else if json.Unmarshal([]byte(line), &req) != nil {
+				t.Errorf("the batch sent %q", line)
+				return
+			}
+			requests = append(requests, strings.TrimSpace(req.Command+" "+strings.Join(req.Args, " ")))
+			if req.Command == "QUIT" || len(replies[req.Command]) == 0 {
+				return
+			}
+			reply := replies[req.Command][0]
+			replies[req.Command] = replies[req.Command][1:]
+			reply.Type, reply.ID, reply.Command = "reply", req.ID, req.Command
+			data, _ := json.Marshal(reply)
+			server.Write(append(data, '\n'))
+			for _, ev := range after[req.Command] {
+				server.Write([]byte(ev + "\n"))
+			}
+		}
+	}()
+	return conn, func() []string {
+		<-done
+		return requests
+	}
+}
+
+func TestBatchExitStatus(t *testing.T) {
+	ok := serverFrame{Status: 200}
+	tests := []struct {
+		name     string
+		replies  map[string][]serverFrame
+		status   int
+		requests []string
+	}{
+		{"delivered", map[string][]serverFrame{"PROTO": {ok}, "NICK": {ok}, "MSG": {ok}},
+			0, []string{"PROTO", "NICK alice", "MSG bob hi", "QUIT"}},
+		{"nickname taken", map[string][]serverFrame{"PROTO": {ok}, "NICK": {{Status: 400, Message: "Nickname taken"}}},
+			1, []string{"PROTO", "NICK alice"}},
+		{"recipient unknown", map[string][]serverFrame{"PROTO": {ok}, "NICK": {ok}, "MSG": {{Status: 207, Failed: []string{"bob"}}}},
+			1, []string{"PROTO", "NICK alice", "MSG bob hi", "QUIT"}},
+		{"rate limited then delivered", map[string][]serverFrame{"PROTO": {ok}, "NICK": {ok},
+			"MSG": {{Status: 429, Data: map[string]any{"retry_after": 0.01}}, ok}},
+			0, []string{"PROTO", "NICK alice", "MSG bob hi", "MSG bob hi", "QUIT"}},
+		{"server gone", map[string][]serverFrame{"PROTO": {ok}, "NICK": {ok}},
+			1, []string{"PROTO", "NICK alice", "MSG bob hi"}},
+	}
+	for _, tt := range tests {
+		conn, requests := fakeServer(t, tt.replies, nil)
+		if status := runBatch(conn, "alice", "", "bob", "hi", time.Second, 0); status != tt.status {
+			t.Errorf("%s: exit status %d, want %d", tt.name, status, tt.status)
+		}
+		if got := requests(); !slices.Equal(got, tt.requests) {
+			t.Errorf("%s: sent %q, want %q", tt.name, got, tt.requests)
+		}
+	}
+}
+
+func TestBatchPrintsReplies(t *testing.T) {
+	var printed strings.Builder
+	out = &printed
+	defer func() { out = os.Stdout }()
+
+	ok := serverFrame{Status: 200}
+	conn, _ := fakeServer(t, map[string][]serverFrame{"PROTO": {ok}, "IDENTIFY": {ok}, "MSG": {ok}}, map[string][]string{"MSG": {
+		`{"type": "message", "from": "bob", "to": "alice", "body": "got it"}`,
+		`{"type": "notice", "body": "*** not a message"}`,
+		`{"type": "message", "from": "bob", "to": "#ops", "body": "thanks"}`,
+	}})
+	if status := runBatch(conn, "alice", "secret", "bob", "deployed", time.Second, 100*time.Millisecond); status != 0 {
+		t.Errorf("exit status %d", status)
+	}
+	if got, want := printed.String(), "bob: got it\n[#ops] bob: thanks\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandName returns the name of a command line without its slash, e.g. MSG
+func commandName(command string) string {
+	name, _, _ := strings.Cut(command, " ")
+	return strings.TrimPrefix(name, "/")
+}
+
+// sendReply builds the reply to /MSG from the outcome of SendMessage
+func sendReply(recipients string, result SendResult) Reply {
+	reply := Reply{Status: StatusOK, Success: result.Success, Queued: result.Queued, Failed: result.Failed}
+	if result.ID != "" {
+		reply.Data = map[string]any{"id": result.ID}
+	}
+
+	if result.Rejected != "" {
+		reply.Status = StatusForbidden
+		reply.Message = result.Rejected
+		return reply
+	}
+
+	if len(result.Failed) == 0 && len(result.Queued) == 0 {
+		recipientDisplay := recipients
+		if recipients == "*" {
+			recipientDisplay = "all users"
+		}
+		reply.Message = fmt.Sprintf("Message sent to %s", recipientDisplay)
+		return reply
+	}
+	if len(result.Success) == 0 && len(result.Queued) == 0 {
+		reply.Status = StatusNotFound
+		reply.Message = fmt.Sprintf("No recipients found: %s", strings.Join(result.Failed, ", "))
+		return reply
+	}
+
+	var parts []string
+	if len(result.Success) > 0 {
+		parts = append(parts, fmt.Sprintf("Message sent to %s", strings.Join(result.Success, ", ")))
+	}
+	if len(result.Queued) > 0 {
+		if len(result.Success) == 0 {
+			parts = append(parts, fmt.Sprintf("Message queued for offline delivery: %s", strings.Join(result.Queued, ", ")))
+		} else {
+			parts = append(parts, fmt.Sprintf("queued for offline delivery: %s", strings.Join(result.Queued, ", ")))
+		}
+	}
+	if len(result.Failed) > 0 {
+		reply.Status = StatusPartial
+		parts = append(parts, fmt.Sprintf("recipients not found: %s", strings.Join(result.Failed, ", ")))
+	}
+	reply.Message = strings.Join(parts, ", ")
+	return reply
+}
+
+// Command is a chat command such as /MSG. The registry checks a command's
+// preconditions and arity before its handler runs.
+type Command struct {
+	Name     string   // Name without the slash, e.g. MSG
+	Aliases  []string // Other names for the command, e.g. M
+	Usage    string   // Arguments as shown in help, e.g. "<recipients> <message>"
+	Help     string   // One line description for /HELP
+	MinArgs  int      // Fewest arguments accepted
+	MaxArgs  int      // Most arguments accepted
+	Trailing bool     // The last argument takes the rest of the line, spaces included
+	Lenient  bool     // Words past MaxArgs are ignored instead of refused, as /NICK and /LIST always did
+
+	NeedsNick bool // Only users with a nickname may use the command
+	Operator  bool // Only operators may use the command
+	Hidden    bool // Used by clients behind the scenes, left out of the help
+
+	Handler func(ctx *CommandContext) Reply
+}
+
+// CommandContext is what a command handler works with
+type CommandContext struct {
+	Server   *Server
+	Client   *Client
+	Nickname string   // The user's nickname, empty before /NICK
+	Name     string   // The name the command was called by, an alias included
+	Args     []string // The arguments, split according to the command's arity
+
+	disconnect bool // drop the client after the reply
+	silent     bool // send no reply at all
+}
+
+// Disconnect drops the client once the reply has been sent
+func (ctx *CommandContext) Disconnect() {
+	ctx.disconnect = true
+}
+
+// CommandRegistry holds the commands the server understands, by name and alias
+type CommandRegistry struct {
+	mu       sync.RWMutex        // mutex to protect commands and order
+	commands map[string]*Command // commands by upper case name and alias
+	order    []*Command          // commands in the order they were registered, for help
+}
+
+// NewCommandRegistry creates an empty registry
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]*Command)}
+}
+
+// Register adds a command, failing if its name or an alias is already taken
+func (r *CommandRegistry) Register(cmd Command) error {
+	if cmd.Name == "" || cmd.Handler == nil {
+		return errors.New("a command needs a name and a handler")
+	}
+	if cmd.MaxArgs < cmd.MinArgs {
+		return fmt.Errorf("command %s accepts at most %d arguments but needs %d", cmd.Name, cmd.MaxArgs, cmd.MinArgs)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if _, exists := r.commands[strings.ToUpper(name)]; exists {
+			return fmt.Errorf("command /%s is already registered", strings.ToUpper(name))
+		}
+	}
+	c := &cmd
+	for _, name := range names {
+		r.commands[strings.ToUpper(name)] = c
+	}
+	r.order = append(r.order, c)
+	return nil
+}
+
+// Lookup finds a command by name or alias, ignoring case
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cmd, exists := r.commands[strings.ToUpper(strings.TrimPrefix(name, "/"))]
+	return cmd, exists
+}
+
+// Commands returns the commands shown in help, in registration order
+func (r *CommandRegistry) Commands() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var commands []*Command
+	for _, cmd := range r.order {
+		if !cmd.Hidden {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// synopsis returns a command with its arguments, e.g. /MSG <recipients> <message>
+func (c *Command) synopsis() string {
+	if c.Usage == "" {
+		return "/" + c.Name
+	}
+	return "/" + c.Name + " " + c.Usage
+}
+
+// describe returns the full help for a command
+func (c *Command) describe() string {
+	text := c.synopsis()
+	if len(c.Aliases) > 0 {
+		text += " (also /" + strings.Join(c.Aliases, ", /") + ")"
+	}
+	text += " - " + c.Help
+	if c.Operator {
+		text += " (operators only)"
+	}
+	return text
+}
+
+// splitArgs splits a command's arguments on spaces, leaving the rest of
+// the line in the last argument when the command takes trailing text
+func splitArgs(line string, max int, trailing bool) []string {
+	var args []string
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		if trailing && len(args) == max-1 {
+			return append(args, rest)
+		}
+		arg, tail, _ := strings.Cut(rest, " ")
+		args = append(args, arg)
+		rest = strings.TrimLeft(tail, " ")
+	}
+	return args
+}
+
+// Dispatch runs one command line for a client
+func (r *CommandRegistry) Dispatch(ctx *CommandContext, line string) Reply {
+	name, rest, _ := strings.Cut(line, " ")
+	cmd, exists := r.Lookup(name)
+	if !strings.HasPrefix(name, "/") || !exists {
+		ctx.Server.metrics.countCommand("UNKNOWN")
+		return errReply(StatusBadRequest, "%s", r.unknownHelp())
+	}
+	ctx.Server.metrics.countCommand(cmd.Name)
+
+	ctx.Name = strings.ToUpper(strings.TrimPrefix(name, "/"))
+	ctx.Args = splitArgs(rest, cmd.MaxArgs, cmd.Trailing)
+	if cmd.Lenient && len(ctx.Args) > cmd.MaxArgs {
+		ctx.Args = ctx.Args[:cmd.MaxArgs]
+	}
+	switch {
+	case cmd.NeedsNick && ctx.Nickname == "":
+		return errReply(StatusUnauthorized, "You must set a nickname before using /%s. Use /NICK <nickname>", cmd.Name)
+	case cmd.Operator && !ctx.Server.IsOperator(ctx.Client):
+		return errReply(StatusForbidden, "Permission denied: /%s is for operators only", cmd.Name)
+	case len(ctx.Args) < cmd.MinArgs || len(ctx.Args) > cmd.MaxArgs:
+		return errReply(StatusBadRequest, "Invalid %s format. Use %s", cmd.Name, cmd.synopsis())
+	}
+	return cmd.Handler(ctx)
+}
+
+// unknownHelp lists every command for a client that sent something unknown
+func (r *CommandRegistry) unknownHelp() string {
+	var synopses []string
+	for _, cmd := range r.Commands() {
+		synopses = append(synopses, cmd.synopsis())
+	}
+	return "Unknown command. Available commands: " + strings.Join(synopses, ", ")
+}
+
+// RegisterCommand adds a command of its own to the server, e.g. /DEPLOY
+func (s *Server) RegisterCommand(cmd Command) error {
+	return s.commands.Register(cmd)
+}
+
+// builtinCommands are the commands every server has
+func builtinCommands() []Command {
+	return []Command{
+		{Name: "NICK", Aliases: []string{"N"}, Usage: "<nickname>", Help: "Set or change your nickname",
+			MinArgs: 1, MaxArgs: 1, Lenient: true, Handler: cmdNick},
+		{Name: "LIST", Aliases: []string{"L"}, Usage: "[#room]", Help: "List connected users, or the members of a room",
+			MaxArgs: 1, Lenient: true, Handler: cmdList},
+		{Name: "MSG", Aliases: []string{"M"}, Usage: "<recipients> <message>", Help: "Send a message to users, rooms or * for everyone",
+			MinArgs: 2, MaxArgs: 2, Trailing: true, NeedsNick: true, Handler: cmdMsg},
+		{Name: "READ", Usage: "<id|nickname>", Help: "Tell senders you read a message, or every message from a user",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdRead},
+		{Name: "IGNORE", Usage: "<nickname>", Help: "Stop receiving a user's messages",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdIgnore},
+		{Name: "UNIGNORE", Usage: "<nickname>", Help: "Receive an ignored user's messages again",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdIgnore},
+		{Name: "IGNORES", Help: "List the users you are ignoring",
+			NeedsNick: true, Handler: cmdIgnores},
+		{Name: "HIGHLIGHT", Usage: "[add|del <keyword>]", Help: "List the keywords that highlight messages for you, or add or remove one",
+			MaxArgs: 2, NeedsNick: true, Handler: cmdHighlight},
+		{Name: "JOIN", Usage: "#room", Help: "Join a room, creating it if needed",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdJoin},
+		{Name: "PART", Usage: "#room", Help: "Leave a room",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdPart},
+		{Name: "TOPIC", Usage: "#room [topic]", Help: "Show or set a room's topic",
+			MinArgs: 1, MaxArgs: 2, Trailing: true, NeedsNick: true, Handler: cmdTopic},
+		{Name: "REGISTER", Usage: "<password>", Help: "Register your nickname with a password of at least 6 characters",
+			MinArgs: 1, MaxArgs: 1, Trailing: true, NeedsNick: true, Handler: cmdRegister},
+		{Name: "IDENTIFY", Usage: "<nickname> <password>", Help: "Log in to a registered nickname",
+			MinArgs: 2, MaxArgs: 2, Trailing: true, Handler: cmdIdentify},
+		{Name: "HISTORY", Usage: "<nickname|#room|*> [count]", Help: "Show your recent messages with a user, a room or everyone",
+			MinArgs: 1, MaxArgs: 2, NeedsNick: true, Handler: cmdHistory},
+		{Name: "STATS", Usage: "[nickname]", Help: "Show a user's delivery counters",
+			MaxArgs: 1, Handler: cmdStats},
+		{Name: "PROTO", Usage: "json|text", Help: "Switch between JSON frames and plain text",
+			MinArgs: 1, MaxArgs: 1, Handler: cmdProto},
+		{Name: "KICK", Usage: "<nick> [reason]", Help: "Disconnect a user",
+			MinArgs: 1, MaxArgs: 2, Trailing: true, NeedsNick: true, Operator: true, Handler: cmdKick},
+		{Name: "BAN", Usage: "<nick|ip> [duration] [reason]", Help: "Ban a nickname or address, for good without a duration",
+			MinArgs: 1, MaxArgs: 3, Trailing: true, NeedsNick: true, Operator: true, Handler: cmdBan},
+		{Name: "UNBAN", Usage: "<nick|ip>", Help: "Lift a ban",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Operator: true, Handler: cmdUnban},
+		{Name: "MUTE", Usage: "<nick> [duration]", Help: "Stop a user's messages, for good without a duration",
+			MinArgs: 1, MaxArgs: 2, NeedsNick: true, Operator: true, Handler: cmdMute},
+		{Name: "UNMUTE", Usage: "<nick>", Help: "Allow a muted user's messages again",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Operator: true, Handler: cmdUnmute},
+		{Name: "FILTER", Usage: "<reject|redact|flag> <regexp>", Help: "Refuse, censor or report messages matching a pattern, (?i) ignores case",
+			MinArgs: 2, MaxArgs: 2, Trailing: true, NeedsNick: true, Operator: true, Handler: cmdFilter},
+		{Name: "UNFILTER", Usage: "<regexp>", Help: "Remove a message filter",
+			MinArgs: 1, MaxArgs: 1, Trailing: true, NeedsNick: true, Operator: true, Handler: cmdUnfilter},
+		{Name: "FILTERS", Help: "List the message filters",
+			NeedsNick: true, Operator: true, Handler: cmdFilters},
+		{Name: "OP", Usage: "<nick>", Help: "Make a user an operator for their session",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Operator: true, Handler: cmdOp},
+		{Name: "AWAY", Usage: "[message]", Help: "Mark yourself as away",
+			MaxArgs: 1, Trailing: true, NeedsNick: true, Handler: cmdAway},
+		{Name: "BACK", Help: "Mark yourself as back",
+			NeedsNick: true, Handler: cmdBack},
+		{Name: "WHOIS", Usage: "<nickname>", Help: "Show a user's presence and idle time",
+			MinArgs: 1, MaxArgs: 1, Handler: cmdWhois},
+		{Name: "SEND", Usage: "<nickname> <filename> <size>", Help: "Offer a file to a user",
+			MinArgs: 3, MaxArgs: 3, NeedsNick: true, Handler: cmdSend},
+		{Name: "ACCEPT", Usage: "<id>", Help: "Accept a file offer",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdAnswerFile},
+		{Name: "REJECT", Usage: "<id>", Help: "Reject a file offer",
+			MinArgs: 1, MaxArgs: 1, NeedsNick: true, Handler: cmdAnswerFile},
+		{Name: "CHUNK", Usage: "<id> <base64 data>", Help: "Send part of an accepted file",
+			MinArgs: 2, MaxArgs: 2, Hidden: true, Handler: cmdChunk},
+		{Name: "DONE", Usage: "<id> <sha256>", Help: "Finish sending a file",
+			MinArgs: 2, MaxArgs: 2, Hidden: true, Handler: cmdDone},
+		{Name: "RESUME", Usage: "<token>", Help: "Take back a session after a dropped connection",
+			MinArgs: 1, MaxArgs: 1, Handler: cmdResume},
+		{Name: "QUIT", Usage: "[message]", Help: "Leave the chat, releasing your nickname at once",
+			MaxArgs: 1, Trailing: true, Handler: cmdQuit},
+		{Name: "HELP", Usage: "[command]", Help: "List the commands, or explain one",
+			MaxArgs: 1, Handler: cmdHelp},
+	}
+}
+
+// cmdNick registers a nickname, or changes it
+func cmdNick(ctx *CommandContext) Reply {
+	newNick := ctx.Args[0]
+	var success bool
+	var msg string
+	if ctx.Nickname == "" {
+		// register new nickname
+		success, msg = ctx.Server.RegisterClient(newNick, ctx.Client)
+	} else {
+		// change nickname
+		success, msg = ctx.Server.ChangeNickname(ctx.Nickname, newNick, ctx.Client)
+	}
+	reply := newReply(success, msg)
+	if success {
+		ctx.Nickname = newNick
+		reply.Data = map[string]any{"nickname": newNick}
+	}
+	return reply
+}
+
+// cmdList lists the users, or the members of a room
+func cmdList(ctx *CommandContext) Reply {
+	if len(ctx.Args) > 0 && strings.HasPrefix(ctx.Args[0], "#") {
+		// List the members of a room
+		room := ctx.Args[0]
+		topic, members, exists := ctx.Server.RoomInfo(room)
+		if !exists {
+			return errReply(StatusNotFound, "No such room: %s", room)
+		}
+		var reply Reply
+		if topic != "" {
+			reply = okReply("Members of %s (topic: %s): %s", room, topic, strings.Join(members, ", "))
+		} else {
+			reply = okReply("Members of %s: %s", room, strings.Join(members, ", "))
+		}
+		reply.Data = map[string]any{"room": room, "topic": topic, "members": members}
+		return reply
+	}
+
+	// Away users are marked so senders know not to expect an answer
+	names := []string{}
+	var away, display []string
+	for _, user := range ctx.Server.ListUsers() {
+		names = append(names, user.Nickname)
+		if user.Status == "away" {
+			away = append(away, user.Nickname)
+			display = append(display, user.Nickname+" (away)")
+		} else {
+			display = append(display, user.Nickname)
+		}
+	}
+	var reply Reply
+	if len(names) == 0 {
+		reply = okReply("No users currently connected.")
+	} else {
+		reply = okReply("Users: %s", strings.Join(display, ", "))
+	}
+	reply.Data = map[string]any{"users": names, "away": away}
+	return reply
+}
+
+// cmdMsg sends a message, within the sender's rate limits
+func cmdMsg(ctx *CommandContext) Reply {
+	server, client := ctx.Server, ctx.Client
+	recipients, message := ctx.Args[0], ctx.Args[1]
+	ok, wait := server.AllowMessage(client, ctx.Nickname, recipients == "*" || strings.Contains(recipients, "#"))
+	if ok {
+		return sendReply(recipients, server.SendMessage(ctx.Nickname, recipients, message))
+	}
+
+	reply := errReply(StatusTooMany, "Rate limited, retry in %.1fs", wait.Seconds())
+	reply.Data = map[string]any{"retry_after": wait.Seconds()}
+
+	// Keep only the violations from the last minute
+	cutoff := time.Now().Add(-time.Minute)
+	for len(client.violations) > 0 && client.violations[0].Before(cutoff) {
+		client.violations = client.violations[1:]
+	}
+	client.violations = append(client.violations, time.Now())
+	if len(client.violations) >= server.config.MaxViolations {
+		server.logger.Printf("Disconnecting %s (%s) after %d rate limit violations in a minute",
+			ctx.Nickname, client.conn.RemoteAddr(), len(client.violations))
+		reply.Message += ". Too many violations, disconnecting"
+		ctx.Disconnect()
+	}
+	return reply
+}
+
+// cmdRead sends read receipts
+func cmdRead(ctx *CommandContext) Reply {
+	n := ctx.Server.MarkRead(ctx.Nickname, ctx.Args[0])
+	if n == 0 {
+		return errReply(StatusNotFound, "No unread messages for %s", ctx.Args[0])
+	}
+	return okReply("Read receipt sent for %d message(s)", n)
+}
+
+// cmdIgnore adds a user to the ignore list, or removes them with /UNIGNORE
+func cmdIgnore(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.Ignore(ctx.Client, ctx.Args[0], ctx.Name == "IGNORE"))
+}
+
+// cmdIgnores lists the ignored users
+func cmdIgnores(ctx *CommandContext) Reply {
+	ignores := ctx.Server.Ignores(ctx.Client)
+	var reply Reply
+	if len(ignores) == 0 {
+		reply = okReply("You are not ignoring anyone")
+	} else {
+		reply = okReply("Ignoring: %s", strings.Join(ignores, ", "))
+	}
+	reply.Data = map[string]any{"ignores": ignores}
+	return reply
+}
+
+// cmdHighlight lists the highlight keywords, or adds or removes one
+func cmdHighlight(ctx *CommandContext) Reply {
+	if len(ctx.Args) == 0 {
+		keywords := ctx.Server.Highlights(ctx.Client)
+		var reply Reply
+		if len(keywords) == 0 {
+			reply = okReply("You are highlighted by @%s mentions only. Use /HIGHLIGHT add <keyword> for more", ctx.Nickname)
+		} else {
+			reply = okReply("Highlighting @%s and: %s", ctx.Nickname, strings.Join(keywords, ", "))
+		}
+		reply.Data = map[string]any{"highlights": keywords}
+		return reply
+	}
+
+	action := strings.ToLower(ctx.Args[0])
+	if len(ctx.Args) != 2 || (action != "add" && action != "del") {
+		return errReply(StatusBadRequest, "Invalid HIGHLIGHT format. Use /HIGHLIGHT [add|del <keyword>]")
+	}
+	return newReply(ctx.Server.Highlight(ctx.Client, ctx.Args[1], action == "add"))
+}
+
+// cmdJoin joins a room
+func cmdJoin(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.JoinRoom(ctx.Nickname, ctx.Args[0]))
+}
+
+// cmdPart leaves a room
+func cmdPart(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.PartRoom(ctx.Nickname, ctx.Args[0]))
+}
+
+// cmdTopic shows a room's topic, or sets it
+func cmdTopic(ctx *CommandContext) Reply {
+	room := ctx.Args[0]
+	if len(ctx.Args) == 2 {
+		return newReply(ctx.Server.SetTopic(ctx.Nickname, room, ctx.Args[1]))
+	}
+
+	// Show the current topic
+	topic, _, exists := ctx.Server.RoomInfo(room)
+	if !exists {
+		return errReply(StatusNotFound, "No such room: %s", room)
+	}
+	var reply Reply
+	if topic == "" {
+		reply = okReply("No topic set for %s", room)
+	} else {
+		reply = okReply("Topic of %s: %s", room, topic)
+	}
+	reply.Data = map[string]any{"room": room, "topic": topic}
+	return reply
+}
+
+// cmdRegister registers the user's nickname as an account
+func cmdRegister(ctx *CommandContext) Reply {
+	password := ctx.Args[0]
+	if len(password) < 6 {
+		return errReply(StatusBadRequest, "Invalid REGISTER format. Use /REGISTER <password> (at least 6 characters)")
+	}
+	if err := ctx.Server.accounts.Register(ctx.Nickname, password); err != nil {
+		return errReply(StatusBadRequest, "Registration failed: %v", err)
+	}
+	ctx.Server.setAccount(ctx.Client, ctx.Nickname)
+	ctx.Server.restoreIgnores(ctx.Client)
+	ctx.Server.logger.Printf("User %s registered an account", ctx.Nickname)
+	return okReply("Nickname %s registered, you are now identified", ctx.Nickname)
+}
+
+// maxIdentifyFailures is how many wrong passwords a connection may give
+// /IDENTIFY before it is dropped, which slows down guessing
+const maxIdentifyFailures = 3
+
+// cmdIdentify logs in to an account, taking its nickname as well
+func cmdIdentify(ctx *CommandContext) Reply {
+	server, client := ctx.Server, ctx.Client
+	account, password := ctx.Args[0], ctx.Args[1]
+	if !server.accounts.Verify(account, password) {
+		server.logger.Printf("Failed identify attempt for %s from %s", account, client.conn.RemoteAddr())
+		client.identifyFailures++
+		if client.identifyFailures >= maxIdentifyFailures {
+			server.logger.Printf("Disconnecting %s after %d failed identify attempts", client.conn.RemoteAddr(), client.identifyFailures)
+			ctx.Disconnect()
+			return errReply(StatusUnauthorized, "Invalid nickname or password. Too many failed attempts, disconnecting")
+		}
+		return errReply(StatusUnauthorized, "Invalid nickname or password")
+	}
+
+	// The account goes first, a reserved nickname is only taken by its owner
+	previous := server.setAccount(client, account)
+	var reply Reply
+	if ctx.Nickname == account {
+		reply = okReply("You are now identified as %s", account)
+	} else {
+		// Take the account's nickname as well
+		var success bool
+		var msg string
+		if ctx.Nickname == "" {
+			success, msg = server.RegisterClient(account, client)
+		} else {
+			success, msg = server.ChangeNickname(ctx.Nickname, account, client)
+		}
+		if !success {
+			// Without the nickname the client is not identified either
+			server.setAccount(client, previous)
+			return errReply(StatusBadRequest, "Could not identify as %s: %s", account, msg)
+		}
+		ctx.Nickname = account
+		reply = okReply("You are now identified as %s. %s", account, msg)
+	}
+	server.restoreIgnores(client)
+	server.logger.Printf("User %s identified from %s", account, client.conn.RemoteAddr())
+	reply.Data = map[string]any{"nickname": account}
+	return reply
+}
+
+// cmdHistory shows the user's recent messages with someone
+func cmdHistory(ctx *CommandContext) Reply {
+	with := ctx.Args[0]
+	count := 20
+	if len(ctx.Args) == 2 {
+		n, err := strconv.Atoi(ctx.Args[1])
+		if err != nil || n < 1 {
+			return errReply(StatusBadRequest, "Invalid HISTORY format. Use /HISTORY <nickname|#room|*> [count]")
+		}
+		count = n
+	}
+
+	entries, err := ctx.Server.History(ctx.Nickname, with, ctx.Server.historyStart(ctx.Client), min(count, 200))
+	if err != nil {
+		ctx.Server.logger.Printf("Failed to read chat history: %v", err)
+		return errReply(StatusUnavailable, "History is not available right now")
+	}
+	if len(entries) == 0 {
+		return okReply("No history with %s", with)
+	}
+	lines := []string{fmt.Sprintf("History with %s (%d messages):", with, len(entries))}
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("[%s] %s -> %s: %s", e.Time.Format(time.DateTime), e.From, e.To, e.Body))
+	}
+	reply := okReply("%s", strings.Join(lines, "\r\n"))
+	reply.Data = map[string]any{"entries": entries}
+	return reply
+}
+
+// cmdStats shows a user's delivery counters, the caller's own by default
+func cmdStats(ctx *CommandContext) Reply {
+	target := ctx.Nickname
+	if len(ctx.Args) > 0 {
+		target = ctx.Args[0]
+	}
+	if target == "" {
+		return errReply(StatusBadRequest, "Invalid STATS format. Use /STATS [nickname]")
+	}
+	stats, exists := ctx.Server.Stats(target)
+	if !exists {
+		return errReply(StatusNotFound, "No such user: %s", target)
+	}
+	reply := okReply("Stats for %s: queued %d/%d, dropped %d, spilled %d (%d on disk), overflows %d",
+		target, stats.Queued, stats.Capacity, stats.Dropped, stats.Spilled, stats.OnDisk, stats.Overflows)
+	reply.Data = map[string]any{"nickname": target, "stats": stats}
+	return reply
+}
+
+// cmdProto switches the connection between the text and JSON protocols
+func cmdProto(ctx *CommandContext) Reply {
+	mode := strings.ToLower(ctx.Args[0])
+	if mode != "json" && mode != "text" {
+		return errReply(StatusBadRequest, "Unknown protocol %s. Use /PROTO json|text", ctx.Args[0])
+	}
+	// Switch before replying so the reply already uses the new protocol
+	ctx.Client.jsonMode.Store(mode == "json")
+	return okReply("Protocol set to %s", mode)
+}
+
+// durationArg splits an optional duration such as 10m or 2h off the front
+// of an operator command's remaining arguments
+func durationArg(args []string) (time.Duration, string) {
+	if len(args) == 0 {
+		return 0, ""
+	}
+	if d, err := time.ParseDuration(args[0]); err == nil && d > 0 {
+		return d, strings.Join(args[1:], " ")
+	}
+	return 0, strings.Join(args, " ")
+}
+
+// cmdKick disconnects a user
+func cmdKick(ctx *CommandContext) Reply {
+	// The whole rest of the line is the reason
+	reason := "no reason given"
+	if len(ctx.Args) > 1 {
+		reason = ctx.Args[1]
+	}
+	return newReply(ctx.Server.Kick(ctx.Args[0], ctx.Nickname, reason))
+}
+
+// cmdBan bans a nickname or address
+func cmdBan(ctx *CommandContext) Reply {
+	duration, reason := durationArg(ctx.Args[1:])
+	return newReply(ctx.Server.Ban(ctx.Args[0], ctx.Nickname, duration, reason))
+}
+
+// cmdUnban lifts a ban
+func cmdUnban(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.Unban(ctx.Args[0], ctx.Nickname))
+}
+
+// cmdMute silences a user
+func cmdMute(ctx *CommandContext) Reply {
+	duration, _ := durationArg(ctx.Args[1:])
+	return newReply(ctx.Server.Mute(ctx.Args[0], ctx.Nickname, duration))
+}
+
+// cmdUnmute lets a muted user speak again
+func cmdUnmute(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.Unmute(ctx.Args[0], ctx.Nickname))
+}
+
+// cmdFilter adds a message filter
+func cmdFilter(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.AddFilter(FilterAction(strings.ToLower(ctx.Args[0])), ctx.Args[1], ctx.Nickname))
+}
+
+// cmdUnfilter removes a message filter
+func cmdUnfilter(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.RemoveFilter(ctx.Args[0], ctx.Nickname))
+}
+
+// cmdFilters lists the message filters
+func cmdFilters(ctx *CommandContext) Reply {
+	filters := ctx.Server.filters.List()
+	if len(filters) == 0 {
+		return okReply("No message filters")
+	}
+	lines := []string{"Message filters:"}
+	for _, f := range filters {
+		lines = append(lines, fmt.Sprintf("  %s %s (added by %s)", f.Action, f.Pattern, f.By))
+	}
+	reply := okReply("%s", strings.Join(lines, "\r\n"))
+	reply.Data = map[string]any{"filters": filters}
+	return reply
+}
+
+// cmdOp makes a user an operator
+func cmdOp(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.Op(ctx.Args[0], ctx.Nickname))
+}
+
+// cmdAway marks the user as away
+func cmdAway(ctx *CommandContext) Reply {
+	message := "Away"
+	if len(ctx.Args) > 0 {
+		message = ctx.Args[0]
+	}
+	return newReply(ctx.Server.SetAway(ctx.Nickname, message))
+}
+
+// cmdBack marks the user as back
+func cmdBack(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.SetAway(ctx.Nickname, ""))
+}
+
+// cmdWhois shows a user's presence
+func cmdWhois(ctx *CommandContext) Reply {
+	p, exists := ctx.Server.Whois(ctx.Args[0])
+	if !exists {
+		return errReply(StatusNotFound, "No such user: %s", ctx.Args[0])
+	}
+	var reply Reply
+	if p.Server != "" {
+		reply = okReply("%s is %s on server %s, nickname taken %s", p.Nickname, p.Status, p.Server, p.Connected.Format(time.DateTime))
+	} else {
+		lines := []string{fmt.Sprintf("%s is %s from %s", p.Nickname, p.Status, p.Address)}
+		if p.Status == "away" {
+			lines = append(lines, fmt.Sprintf("  away since %s: %s", p.AwaySince.Format(time.DateTime), p.AwayMessage))
+		}
+		if p.Account != "" {
+			lines = append(lines, fmt.Sprintf("  identified as %s", p.Account))
+		}
+		lines = append(lines, fmt.Sprintf("  connected %s, idle %v", p.Connected.Format(time.DateTime), time.Since(p.LastActive).Round(time.Second)))
+		reply = okReply("%s", strings.Join(lines, "\r\n"))
+	}
+	reply.Data = map[string]any{"whois": p}
+	return reply
+}
+
+// cmdSend offers a file to a user
+func cmdSend(ctx *CommandContext) Reply {
+	size, err := strconv.ParseInt(ctx.Args[2], 10, 64)
+	if err != nil {
+		return errReply(StatusBadRequest, "Invalid SEND format. Use /SEND <nickname> <filename> <size>")
+	}
+	transferID, success, msg := ctx.Server.OfferFile(ctx.Nickname, ctx.Args[0], ctx.Args[1], size)
+	if !success {
+		return errReply(StatusBadRequest, "%s", msg)
+	}
+	reply := okReply("%s", msg)
+	reply.Data = map[string]any{"id": transferID}
+	return reply
+}
+
+// cmdAnswerFile accepts or rejects a file offer
+func cmdAnswerFile(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.AnswerFile(ctx.Nickname, ctx.Args[0], ctx.Name == "ACCEPT"))
+}
+
+// cmdChunk takes part of a file, the sender's client streams an accepted file with these
+func cmdChunk(ctx *CommandContext) Reply {
+	data, err := base64.StdEncoding.DecodeString(ctx.Args[1])
+	if err != nil {
+		return errReply(StatusBadRequest, "Invalid CHUNK format. Use /CHUNK <transfer id> <base64 data>")
+	}
+	success, msg := ctx.Server.FileChunk(ctx.Nickname, ctx.Args[0], data)
+	if !success {
+		return errReply(StatusBadRequest, "%s", msg)
+	}
+	// Chunks are only answered when they fail, a reply for each would double the traffic
+	ctx.silent = true
+	return Reply{}
+}
+
+// cmdDone ends a transfer with the SHA-256 of the whole file
+func cmdDone(ctx *CommandContext) Reply {
+	return newReply(ctx.Server.FinishFile(ctx.Nickname, ctx.Args[0], ctx.Args[1]))
+}
+
+// cmdResume takes over a session held after a dropped connection
+func cmdResume(ctx *CommandContext) Reply {
+	if ctx.Nickname != "" {
+		return errReply(StatusBadRequest, "You already have a nickname, /RESUME is only for new connections")
+	}
+	nickname, success, msg := ctx.Server.Resume(ctx.Args[0], ctx.Client)
+	if !success {
+		return errReply(StatusNotFound, "%s", msg)
+	}
+	ctx.Nickname = nickname
+	reply := okReply("%s", msg)
+	reply.Data = map[string]any{"nickname": nickname}
+	return reply
+}
+
+// cmdQuit leaves for good instead of holding the nickname for a resume
+func cmdQuit(ctx *CommandContext) Reply {
+	ctx.Disconnect()
+	return okReply("Goodbye")
+}
+
+// cmdHelp lists the commands, or explains one
+func cmdHelp(ctx *CommandContext) Reply {
+	commands := ctx.Server.commands
+	if len(ctx.Args) == 1 {
+		cmd, exists := commands.Lookup(ctx.Args[0])
+		if !exists {
+			return errReply(StatusNotFound, "No such command: %s", ctx.Args[0])
+		}
+		reply := okReply("%s", cmd.describe())
+		reply.Data = map[string]any{"command": cmd.Name, "aliases": cmd.Aliases, "usage": cmd.synopsis(), "help": cmd.Help}
+		return reply
+	}
+
+	lines := []string{"Available commands:"}
+	var names []string
+	for _, cmd := range commands.Commands() {
+		lines = append(lines, "  "+cmd.describe())
+		names = append(names, cmd.Name)
+	}
+	reply := okReply("%s", strings.Join(lines, "\r\n"))
+	reply.Data = map[string]any{"commands": names}
+	return reply
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FilterAction is what a filter does to a message it matches
+type FilterAction string
+
+const (
+	FilterReject FilterAction = "reject" // Refuse the whole message
+	FilterRedact FilterAction = "redact" // Replace the matching text with asterisks
+	FilterFlag   FilterAction = "flag"   // Deliver the message, but report it to the operators
+)
+
+// Filter is a regular expression messages are checked against before delivery
+type Filter struct {
+	Pattern string       `json:"pattern"`
+	Action  FilterAction `json:"action"`
+	By      string       `json:"by"` // Operator who added the filter
+
+	re *regexp.Regexp
+}
+
+// FilterList keeps the message filters, persisted so they survive restarts
+type FilterList struct {
+	mu      sync.Mutex // mutex to protect filters
+	path    string     // File the filters are persisted to
+	filters []*Filter  // Filters in the order they were added
+}
+
+// NewFilterList creates a filter list, loading any filters previously saved at path
+func NewFilterList(path string) (*FilterList, error) {
+	f := &FilterList{path: path}
+	if err := readJSONFile(path, &f.filters); err != nil {
+		return nil, err
+	}
+	for _, filter := range f.filters {
+		re, err := regexp.Compile(filter.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		filter.re = re
+	}
+	return f, nil
+}
+
+// Add adds a filter, replacing any earlier filter with the same pattern
+func (f *FilterList) Add(filter Filter) error {
+	re, err := regexp.Compile(filter.Pattern)
+	if err != nil {
+		return err
+	}
+	filter.re = re
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.filters = slices.DeleteFunc(f.filters, func(old *Filter) bool { return old.Pattern == filter.Pattern })
+	f.filters = append(f.filters, &filter)
+	return writeJSONFile(f.path, f.filters)
+}
+
+// Remove removes the filter with the given pattern
+func (f *FilterList) Remove(pattern string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(f.filters)
+	f.filters = slices.DeleteFunc(f.filters, func(old *Filter) bool { return old.Pattern == pattern })
+	if len(f.filters) == n {
+		return false
+	}
+	writeJSONFile(f.path, f.filters)
+	return true
+}
+
+// List returns the filters in the order they were added
+func (f *FilterList) List() []Filter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filters := make([]Filter, len(f.filters))
+	for i, filter := range f.filters {
+		filters[i] = *filter
+	}
+	return filters
+}
+
+// Apply runs a message through the filters, returning the text to deliver,
+// whether a filter refused it, and the patterns of the filters that flagged it
+func (f *FilterList) Apply(message string) (string, bool, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var flagged []string
+	for _, filter := range f.filters {
+		switch filter.Action {
+		case FilterReject:
+			if filter.re.MatchString(message) {
+				return message, true, nil
+			}
+		case FilterRedact:
+			message = filter.re.ReplaceAllStringFunc(message, func(match string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(match))
+			})
+		case FilterFlag:
+			if filter.re.MatchString(message) {
+				flagged = append(flagged, filter.Pattern)
+			}
+		}
+	}
+	return message, false, flagged
+}
+
+// Ignore adds a nickname to a user's ignore list, or removes it. The list
+// of an identified user is saved with the account, so it outlives the
+// connection.
+func (s *Server) Ignore(client *Client, target string, ignore bool) (bool, string) {
+	valid, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]{0,11}$`, target)
+	if !valid {
+		return false, "Invalid nickname format"
+	}
+
+	s.mu.Lock()
+	if ignore {
+		if target == client.nickname {
+			s.mu.Unlock()
+			return false, "You can't ignore yourself"
+		}
+		if client.ignores[target] {
+			s.mu.Unlock()
+			return false, fmt.Sprintf("You are already ignoring %s", target)
+		}
+		if client.ignores == nil {
+			client.ignores = make(map[string]bool)
+		}
+		client.ignores[target] = true
+	} else {
+		if !client.ignores[target] {
+			s.mu.Unlock()
+			return false, fmt.Sprintf("You are not ignoring %s", target)
+		}
+		delete(client.ignores, target)
+	}
+	ignores := ignoreList(client)
+	s.mu.Unlock()
+
+	s.saveIgnores(client.account, ignores)
+	if ignore {
+		return true, fmt.Sprintf("Ignoring %s", target)
+	}
+	return true, fmt.Sprintf("No longer ignoring %s", target)
+}
+
+// Ignores returns the nicknames a user is ignoring, sorted
+func (s *Server) Ignores(client *Client) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ignoreList(client)
+}
+
+// restoreIgnores merges the ignore list saved with the account a client
+// has just identified as into its session's list, and saves the result
+func (s *Server) restoreIgnores(client *Client) {
+	saved := s.accounts.Ignores(client.account)
+
+	s.mu.Lock()
+	if client.ignores == nil {
+		client.ignores = make(map[string]bool)
+	}
+	for _, nick := range saved {
+		client.ignores[nick] = true
+	}
+	ignores := ignoreList(client)
+	s.mu.Unlock()
+
+	if len(ignores) > len(saved) {
+		s.saveIgnores(client.account, ignores)
+	}
+}
+
+// saveIgnores saves an ignore list with an account, if there is one
+func (s *Server) saveIgnores(account string, ignores []string) {
+	if account == "" {
+		return
+	}
+	if err := s.accounts.SetIgnores(account, ignores); err != nil {
+		s.logger.Printf("Failed to save the ignore list of %s: %v", account, err)
+	}
+}
+
+// ignoreList returns a client's ignore list sorted, the caller must hold s.mu
+func ignoreList(client *Client) []string {
+	ignores := make([]string, 0, len(client.ignores))
+	for nick := range client.ignores {
+		ignores = append(ignores, nick)
+	}
+	sort.Strings(ignores)
+	return ignores
+}
+
+// AddFilter checks every message from now on against a pattern
+func (s *Server) AddFilter(action FilterAction, pattern, by string) (bool, string) {
+	switch action {
+	case FilterReject, FilterRedact, FilterFlag:
+	default:
+		return false, fmt.Sprintf("Unknown filter action %s. Use reject, redact or flag", action)
+	}
+	if err := s.filters.Add(Filter{Pattern: pattern, Action: action, By: by}); err != nil {
+		return false, fmt.Sprintf("Invalid pattern: %v", err)
+	}
+	s.logger.Printf("Operator %s added a %s filter: %s", by, action, pattern)
+	return true, fmt.Sprintf("Messages matching %s will be %s", pattern, map[FilterAction]string{
+		FilterReject: "rejected", FilterRedact: "redacted", FilterFlag: "flagged",
+	}[action])
+}
+
+// RemoveFilter stops checking messages against a pattern
+func (s *Server) RemoveFilter(pattern, by string) (bool, string) {
+	if !s.filters.Remove(pattern) {
+		return false, fmt.Sprintf("No filter for %s", pattern)
+	}
+	s.logger.Printf("Operator %s removed the filter %s", by, pattern)
+	return true, fmt.Sprintf("Removed the filter %s", pattern)
+}
+
+// ignoredBy counts a recipient who ignores the sender, as failed or, for
+// the drop mode, in the list the message would otherwise have gone to
+func (s *Server) ignoredBy(result *SendResult, nickname string, sent *[]string) {
+	if s.config.IgnoreMode == IgnoreFail {
+		result.Failed = append(result.Failed, nickname)
+	} else {
+		*sent = append(*sent, nickname)
+	}
+}
+
+// flagMessage reports a message that matched a flag filter to the online
+// operators, the caller must hold s.mu
+func (s *Server) flagMessage(sender, recipients, message string, patterns []string) {
+	s.logger.Printf("Flagged message from %s to %s (matched %s): %s", sender, recipients, strings.Join(patterns, ", "), message)
+	notice := fmt.Sprintf("*** Flagged message from %s to %s: %s", sender, recipients, message)
+	for nick, client := range s.clients {
+		if nick != sender && s.IsOperator(client) {
+			s.deliver(nick, client, Event{Type: "notice", Body: notice, Time: time.Now()})
+		}
+	}
+}
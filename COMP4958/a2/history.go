@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one routed message in the chat log
+type HistoryEntry struct {
+	Time       time.Time `json:"time"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`         // "*", a room, or the direct recipients
+	Recipients []string  `json:"recipients"` // Users the message was delivered to
+	Body       string    `json:"body"`
+}
+
+// History is an append-only log of routed messages, rotated by size
+type History struct {
+	mu      sync.Mutex // mutex to protect file and size
+	path    string     // Current log file, rotated files get a .1, .2, ... suffix
+	maxSize int64      // Size in bytes at which the log is rotated
+	keep    int        // Number of rotated files to keep
+	file    *os.File   // Open handle of the current log file
+	size    int64      // Current size of the log file
+}
+
+// NewHistory opens the chat log at path for appending
+func NewHistory(path string, maxSize int64, keep int) (*History, error) {
+	h := &History{path: path, maxSize: maxSize, keep: keep}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open opens the current log file, the caller must hold h.mu
+func (h *History) open() error {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	h.file = file
+	h.size = info.Size()
+	return nil
+}
+
+// rotate moves the current log to path.1, shifting older logs up by one,
+// the caller must hold h.mu
+func (h *History) rotate() error {
+	h.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", h.path, h.keep))
+	for i := h.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", h.path, i), fmt.Sprintf("%s.%d", h.path, i+1))
+	}
+	if h.keep > 0 {
+		os.Rename(h.path, h.path+".1")
+	} else {
+		os.Remove(h.path)
+	}
+	return h.open()
+}
+
+// Append writes an entry to the end of the log
+func (h *History) Append(entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.size > 0 && h.size+int64(len(line)) > h.maxSize {
+		if err := h.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := h.file.Write(line)
+	h.size += int64(n)
+	return err
+}
+
+// Recent returns the last n entries accepted by match, oldest first,
+// reading the rotated logs before the current one. The files are opened
+// under the lock and read after it is released, so a long scan doesn't
+// hold up Append; a rotation meanwhile only renames the open files.
+func (h *History) Recent(n int, match func(HistoryEntry) bool) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i := h.keep; i >= 0; i-- {
+		path := h.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", h.path, i)
+		}
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	// Lines appended to the current log from here on are left for next time
+	size := h.size
+	h.mu.Unlock()
+
+	var entries []HistoryEntry
+	for i, file := range files {
+		var r io.Reader = file
+		if i == len(files)-1 && file.Name() == h.path {
+			r = io.LimitReader(file, size)
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !match(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			// Only the last n matches are needed
+			if len(entries) > n {
+				entries = entries[1:]
+			}
+		}
+	}
+	return entries, nil
+}
+
+// logHistory records a delivered message in the chat log
+func (s *Server) logHistory(sender, to string, recipients []string, message string) {
+	sort.Strings(recipients)
+	entry := HistoryEntry{Time: time.Now(), From: sender, To: to, Recipients: recipients, Body: message}
+	if err := s.history.Append(entry); err != nil {
+		s.logger.Printf("Failed to write chat history: %v", err)
+	}
+}
+
+// History returns the last n messages since a time that a user was a party
+// to. With "*" every such message is included, a room selects that room's
+// messages and a nickname selects direct messages exchanged with that user.
+func (s *Server) History(nickname, with string, since time.Time, n int) ([]HistoryEntry, error) {
+	party := func(e HistoryEntry) bool {
+		return e.From == nickname || slices.Contains(e.Recipients, nickname)
+	}
+	return s.history.Recent(n, func(e HistoryEntry) bool {
+		switch {
+		case e.Time.Before(since):
+			return false
+		case with == "*":
+			return party(e)
+		case strings.HasPrefix(with, "#"):
+			return e.To == with && party(e)
+		case e.To == "*" || strings.HasPrefix(e.To, "#"):
+			return false
+		default:
+			return (e.From == nickname && slices.Contains(e.Recipients, with)) ||
+				(e.From == with && slices.Contains(e.Recipients, nickname))
+		}
+	})
+}
+
+// historyStart returns the earliest message a client may see in the
+// history. The log is kept by nickname and a nickname may have been used
+// by others before, so only the owner of a reserved nickname sees messages
+// from before the user took it, back to when it was registered.
+func (s *Server) historyStart(client *Client) time.Time {
+	s.mu.RLock()
+	nickname, account, since := client.nickname, client.account, client.since
+	s.mu.RUnlock()
+
+	if s.config.ReserveNicks && account != "" && account == nickname {
+		if created, exists := s.accounts.Created(account); exists {
+			return created
+		}
+	}
+	return since
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircConn adapts an IRC client's connection to net.Conn so handleConnection
+// can serve it like any other client. The IRC commands read from the client
+// become JSON request frames, and the JSON replies and events written back
+// become IRC messages, so IRC users and native users share nicknames, rooms
+// and messages. Only the subset of RFC 1459 a chat client needs is spoken.
+type ircConn struct {
+	net.Conn               // Connection to the IRC client
+	reader   *bufio.Reader // Buffered reader for IRC lines
+	pending  []byte        // Request frames not yet read by handleConnection
+	host     string        // Name of this server in IRC messages
+	created  time.Time     // When the server started, for the welcome burst
+
+	mu         sync.Mutex      // mutex to protect the fields below and keep lines from concurrent writers apart
+	nickname   string          // Nickname registered, or asked for during registration
+	user       bool            // USER has been received
+	registered bool            // The welcome burst has been sent
+	joined     map[string]bool // Channels whose JOIN succeeded, so their NAMES reply is shown
+}
+
+// newIRCConn wraps an accepted IRC connection
+func newIRCConn(server *Server, conn net.Conn) *ircConn {
+	host, _, _ := strings.Cut(server.config.ServerName, ":")
+	return &ircConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		host:    host,
+		created: server.started,
+		joined:  make(map[string]bool),
+
+		// Everything below relies on the structured replies of the JSON
+		// protocol, which the connection starts without
+		pending: []byte("/PROTO json\n"),
+	}
+}
+
+// serveIRC accepts IRC clients on a listener until it is closed
+func serveIRC(server *Server, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			server.logger.Printf("Error accepting IRC connection: %v", err)
+			continue
+		}
+
+		go handleConnection(server, newIRCConn(server, conn))
+	}
+}
+
+// ircRequest builds a JSON request frame for handleConnection
+func ircRequest(id, command string, args ...string) []byte {
+	data, _ := json.Marshal(request{ID: id, Command: command, Args: args})
+	return append(data, '\n')
+}
+
+// parseIRC splits an IRC message into its upper case command and its
+// parameters, dropping any prefix
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var params []string
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if trailing, ok := strings.CutPrefix(line, ":"); ok && len(params) > 0 {
+			params = append(params, trailing)
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		params = append(params, param)
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// Read hands handleConnection the request frames translated from IRC
+func (c *ircConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.translate(line)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// translate turns one IRC message into request frames, answering the
+// messages that need nothing from the server itself
+func (c *ircConn) translate(line string) []byte {
+	command, params := parseIRC(line)
+	arg := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Registration, keepalives and quitting work before the welcome burst
+	switch command {
+	case "", "PASS":
+		return nil
+	case "CAP":
+		// No capabilities are offered, which lets clients carry on registering
+		if strings.ToUpper(arg(0)) == "LS" {
+			c.send(c.host, "CAP", "*", "LS", "")
+		}
+		return nil
+	case "PING":
+		c.send(c.host, "PONG", c.host, arg(0))
+		return nil
+	case "PONG":
+		// Answers the server's keepalive PING, whose token is the last parameter
+		if len(params) == 0 {
+			return nil
+		}
+		return ircRequest("", "PONG", params[len(params)-1])
+	case "QUIT":
+		return ircRequest("irc:quit", "QUIT", params...)
+	case "NICK":
+		if arg(0) == "" {
+			c.numeric("431", "No nickname given")
+			return nil
+		}
+		if c.registered {
+			return ircRequest("irc:nick:"+arg(0), "NICK", arg(0))
+		}
+		c.nickname = arg(0)
+		if c.user {
+			return ircRequest("irc:register", "NICK", c.nickname)
+		}
+		return nil
+	case "USER":
+		if c.registered || c.user {
+			c.numeric("462", "You may not reregister")
+			return nil
+		}
+		c.user = true
+		if c.nickname != "" {
+			return ircRequest("irc:register", "NICK", c.nickname)
+		}
+		return nil
+	}
+
+	if !c.registered {
+		c.numeric("451", "You have not registered")
+		return nil
+	}
+
+	switch command {
+	case "PRIVMSG", "NOTICE":
+		if arg(0) == "" {
+			c.numeric("411", "No recipient given ("+command+")")
+			return nil
+		}
+		if arg(1) == "" {
+			c.numeric("412", "No text to send")
+			return nil
+		}
+		return ircRequest("irc:"+strings.ToLower(command), "MSG", arg(0), arg(1))
+	case "JOIN":
+		// Each JOIN is followed by NAMES, shown once the JOIN has succeeded
+		var frames []byte
+		for _, channel := range strings.Split(arg(0), ",") {
+			frames = append(frames, ircRequest("irc:join:"+channel, "JOIN", channel)...)
+			frames = append(frames, ircRequest("irc:joinnames:"+channel, "LIST", channel)...)
+		}
+		return frames
+	case "PART":
+		var frames []byte
+		for _, channel := range strings.Split(arg(0), ",") {
+			frames = append(frames, ircRequest("irc:part:"+channel, "PART", channel)...)
+		}
+		return frames
+	case "NAMES":
+		if arg(0) == "" {
+			c.numeric("366", "*", "End of /NAMES list")
+			return nil
+		}
+		var frames []byte
+		for _, channel := range strings.Split(arg(0), ",") {
+			frames = append(frames, ircRequest("irc:names:"+channel, "LIST", channel)...)
+		}
+		return frames
+	case "WHO":
+		switch {
+		case arg(0) == "":
+			c.numeric("315", "*", "End of /WHO list")
+			return nil
+		case strings.HasPrefix(arg(0), "#"):
+			return ircRequest("irc:who:"+arg(0), "LIST", arg(0))
+		default:
+			return ircRequest("irc:who:"+arg(0), "WHOIS", arg(0))
+		}
+	case "WHOIS":
+		// The nickname is last, a server may come before it
+		if len(params) == 0 || params[len(params)-1] == "" {
+			c.numeric("431", "No nickname given")
+			return nil
+		}
+		target := params[len(params)-1]
+		return ircRequest("irc:whois:"+target, "WHOIS", target)
+	case "TOPIC":
+		if len(params) > 1 {
+			return ircRequest("irc:settopic:"+arg(0), "TOPIC", arg(0), arg(1))
+		}
+		return ircRequest("irc:topic:"+arg(0), "TOPIC", arg(0))
+	case "AWAY":
+		if arg(0) == "" {
+			return ircRequest("irc:back", "BACK")
+		}
+		return ircRequest("irc:away", "AWAY", arg(0))
+	case "MODE":
+		// Rooms and users have no modes, but clients ask after joining
+		if strings.HasPrefix(arg(0), "#") {
+			c.numeric("324", arg(0), "+")
+		} else {
+			c.numeric("221", "+")
+		}
+		return nil
+	}
+
+	// Switching protocols would leave this adapter unable to read the replies
+	if command == "PROTO" {
+		c.numeric("421", command, "Unknown command")
+		return nil
+	}
+
+	// Anything else is passed on as a native command, e.g. /HISTORY, and
+	// answered with notices
+	return ircRequest("irc:native", command, params...)
+}
+
+// Write turns the lines handleConnection writes into IRC messages
+func (c *ircConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\r\n") {
+		if err := c.render(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ircFrame is a reply or an event written by handleConnection
+type ircFrame struct {
+	Event
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	Reply
+}
+
+// render writes the IRC messages for one line, the caller must hold c.mu
+func (c *ircConn) render(line string) error {
+	var f ircFrame
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &f) != nil {
+		// Text written before the switch to JSON, such as the welcome or a ban
+		return c.send(c.host, "NOTICE", c.target(), line)
+	}
+
+	switch f.Type {
+	case "reply":
+		return c.renderReply(f)
+	case "message":
+		to, body := f.To, f.Body
+		switch {
+		case f.Offline:
+			to, body = c.target(), fmt.Sprintf("[offline, %s] %s", f.Time.Local().Format(time.DateTime), body)
+		case to == "*":
+			to, body = c.target(), "[to all] "+body
+		case !strings.HasPrefix(to, "#"):
+			to = c.target()
+		}
+		return c.send(c.mask(f.From), "PRIVMSG", to, body)
+	case "notice":
+		to := c.target()
+		if strings.HasPrefix(f.To, "#") {
+			to = f.To
+		}
+		return c.send(c.host, "NOTICE", to, f.Body)
+	case "ping":
+		return c.send("", "PING", f.Body)
+	case "resume", "delivered":
+		// IRC clients can't resume, a dropped connection is simply gone, and
+		// IRC has no acknowledgements, a message sent is taken as delivered
+		return nil
+	default:
+		// Read receipts, and file transfers, which need the native client
+		ev := f.Event
+		ev.ID = f.ID
+		return c.send(c.host, "NOTICE", c.target(), ev.text())
+	}
+}
+
+// renderReply answers an IRC command from the reply to its request frame,
+// the caller must hold c.mu
+func (c *ircConn) renderReply(f ircFrame) error {
+	// Ids look like irc:join:#room, the subject being a room or a nickname
+	kind, subject, _ := strings.Cut(strings.TrimPrefix(f.ID, "irc:"), ":")
+	failed := f.Status >= 400
+	data := func(key string) string {
+		s, _ := f.Data[key].(string)
+		return s
+	}
+
+	switch kind {
+	case "":
+		if f.Command == "PROTO" {
+			// The switch to JSON made by newIRCConn
+			return nil
+		}
+	case "register":
+		if failed {
+			nickname := c.nickname
+			c.nickname = ""
+			return c.nickError(nickname, f.Message)
+		}
+		c.nickname = data("nickname")
+		c.registered = true
+		return c.welcome()
+	case "nick":
+		if failed {
+			return c.nickError(subject, f.Message)
+		}
+		old := c.nickname
+		c.nickname = data("nickname")
+		return c.send(c.mask(old), "NICK", c.nickname)
+	case "quit":
+		return c.send("", "ERROR", "Closing link: "+f.Message)
+	case "privmsg":
+		for _, target := range f.Failed {
+			if strings.HasPrefix(target, "#") {
+				c.numeric("404", target, "Cannot send to subject")
+			} else {
+				c.numeric("401", target, "No such nick/subject")
+			}
+		}
+		if f.Status == StatusTooMany || f.Status == StatusForbidden {
+			return c.send(c.host, "NOTICE", c.target(), f.Message)
+		}
+		return nil
+	case "notice":
+		// Notices are never answered, failures included
+		return nil
+	case "join":
+		if failed {
+			return c.numeric("403", subject, f.Message)
+		}
+		c.joined[subject] = true
+		return c.send(c.mask(c.nickname), "JOIN", subject)
+	case "joinnames":
+		if !c.joined[subject] {
+			return nil
+		}
+		delete(c.joined, subject)
+		if topic := data("topic"); topic != "" {
+			c.numeric("332", subject, topic)
+		}
+		return c.names(subject, f.Data["members"])
+	case "names":
+		if failed {
+			return c.numeric("366", subject, "End of /NAMES list")
+		}
+		return c.names(subject, f.Data["members"])
+	case "part":
+		if failed {
+			return c.numeric("442", subject, f.Message)
+		}
+		return c.send(c.mask(c.nickname), "PART", subject)
+	case "who":
+		if !failed && strings.HasPrefix(subject, "#") {
+			members, _ := f.Data["members"].([]any)
+			for _, m := range members {
+				nick, _ := m.(string)
+				c.numeric("352", subject, nick, c.host, c.host, nick, "H", "0 "+nick)
+			}
+		} else if whois, ok := f.Data["whois"].(map[string]any); ok {
+			nick, _ := whois["nickname"].(string)
+			flag := "H"
+			if whois["status"] == "away" {
+				flag = "G"
+			}
+			c.numeric("352", "*", nick, c.host, c.host, nick, flag, "0 "+nick)
+		}
+		return c.numeric("315", subject, "End of /WHO list")
+	case "whois":
+		whois, ok := f.Data["whois"].(map[string]any)
+		if failed || !ok {
+			c.numeric("401", subject, "No such nick/subject")
+			return c.numeric("318", subject, "End of /WHOIS list")
+		}
+		server, _ := whois["server"].(string)
+		if server == "" {
+			server = c.host
+		}
+		c.numeric("311", subject, subject, c.host, "*", subject)
+		c.numeric("312", subject, server, "Go Chat Server")
+		if whois["status"] == "away" {
+			away, _ := whois["away_message"].(string)
+			c.numeric("301", subject, away)
+		}
+		return c.numeric("318", subject, "End of /WHOIS list")
+	case "topic":
+		switch {
+		case failed:
+			return c.numeric("403", subject, f.Message)
+		case data("topic") == "":
+			return c.numeric("331", subject, "No topic is set")
+		default:
+			return c.numeric("332", subject, data("topic"))
+		}
+	case "settopic":
+		if failed {
+			return c.numeric("482", subject, f.Message)
+		}
+		return c.send(c.host, "NOTICE", subject, f.Message)
+	case "away":
+		return c.numeric("306", "You have been marked as being away")
+	case "back":
+		return c.numeric("305", "You are no longer marked as being away")
+	}
+
+	// Replies to native commands, and to frames the server couldn't parse
+	if failed && strings.HasPrefix(f.Message, "Unknown command") {
+		return c.numeric("421", f.Command, "Unknown command")
+	}
+	for _, text := range strings.Split(f.Message, "\r\n") {
+		if err := c.send(c.host, "NOTICE", c.target(), text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// welcome sends the burst that completes registration, the caller must hold c.mu
+func (c *ircConn) welcome() error {
+	c.numeric("001", "Welcome to the Go Chat Server, "+c.mask(c.nickname))
+	c.numeric("002", "Your host is "+c.host+", running a2")
+	c.numeric("003", "This server was created "+c.created.Format(time.RFC1123))
+	c.numeric("004", c.host, "a2", "o", "o")
+	c.numeric("005", "CHANTYPES=#", "NICKLEN=12", "CHANNELLEN=21", "are supported by this server")
+	c.numeric("375", "- "+c.host+" Message of the day -")
+	c.numeric("372", "- IRC and native chat clients share the same nicknames and rooms.")
+	c.numeric("372", "- Commands IRC doesn't know, such as HISTORY or HELP, are passed to the chat server.")
+	return c.numeric("376", "End of /MOTD command")
+}
+
+// nickError explains a refused nickname, the caller must hold c.mu
+func (c *ircConn) nickError(nickname, message string) error {
+	if strings.Contains(message, "in use") {
+		return c.numeric("433", nickname, "Nickname is already in use")
+	}
+	return c.numeric("432", nickname, message)
+}
+
+// names lists a channel's members, the caller must hold c.mu
+func (c *ircConn) names(channel string, list any) error {
+	members, _ := list.([]any)
+	var nicks []string
+	for _, m := range members {
+		if nick, ok := m.(string); ok {
+			nicks = append(nicks, nick)
+		}
+	}
+	if len(nicks) > 0 {
+		c.numeric("353", "=", channel, strings.Join(nicks, " "))
+	}
+	return c.numeric("366", channel, "End of /NAMES list")
+}
+
+// target is who server messages are addressed to, * before registration
+func (c *ircConn) target() string {
+	if c.nickname == "" || !c.registered {
+		return "*"
+	}
+	return c.nickname
+}
+
+// mask returns a user's full IRC name, e.g. bob!bob@server
+func (c *ircConn) mask(nickname string) string {
+	return nickname + "!" + nickname + "@" + c.host
+}
+
+// numeric sends a numeric reply to the user, the caller must hold c.mu
+func (c *ircConn) numeric(code string, params ...string) error {
+	return c.send(c.host, code, append([]string{c.target()}, params...)...)
+}
+
+// send writes one IRC message, the last parameter always in trailing form.
+// The caller must hold c.mu.
+func (c *ircConn) send(prefix, command string, params ...string) error {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + param)
+		} else {
+			b.WriteString(" " + param)
+		}
+	}
+	b.WriteString("\r\n")
+	_, err := c.Conn.Write([]byte(b.String()))
+	return err
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// linkQueue is how many frames may wait for a linked server on top of the
+// initial burst of users before the link is dropped as too slow
+const linkQueue = 1024
+
+// Link is a connection to a neighboring server. Every frame received on a
+// link is passed on to the other links, so linked servers must form a tree,
+// a cycle would pass frames around forever. A link that would close one is
+// refused, or dropped once it turns out to. Rooms stay local to each server.
+type Link struct {
+	name  string         // Name of the server at the other end
+	conn  net.Conn       // Connection to that server
+	outCh chan linkFrame // Frames waiting to be written
+}
+
+// RemoteUser is a user connected to another server of the network
+type RemoteUser struct {
+	Nickname string
+	Server   string // Server the user is connected to
+	Since    int64  // When the user took the nickname, in Unix nanoseconds
+	link     *Link  // Link the user is reached through
+}
+
+// presence describes a remote user, all that is known is where they are
+func (u *RemoteUser) presence() Presence {
+	return Presence{Nickname: u.Nickname, Server: u.Server, Status: "online", Connected: time.Unix(0, u.Since)}
+}
+
+// linkFrame is one line of the server-to-server protocol
+type linkFrame struct {
+	Type   string    `json:"type"`             // hello, user, quit or msg
+	Server string    `json:"server,omitempty"` // Server a user is on, or the server saying hello
+	Secret string    `json:"secret,omitempty"` // Link secret, only sent in a hello
+	Nick   string    `json:"nick,omitempty"`   // User joining or leaving the network
+	Since  int64     `json:"since,omitempty"`  // When the user took the nickname, in Unix nanoseconds
+	From   string    `json:"from,omitempty"`   // Sender of a message
+	To     string    `json:"to,omitempty"`     // Recipient of a message, "*" for everyone
+	Body   string    `json:"body,omitempty"`   // Message text
+	Time   time.Time `json:"time,omitzero"`    // When the message was sent
+}
+
+// send queues a frame for the linked server, dropping the link if it can't keep up
+func (l *Link) send(f linkFrame) {
+	select {
+	case l.outCh <- f:
+	default:
+		l.conn.Close()
+	}
+}
+
+// beats settles a nickname collision between two servers: whoever took the
+// nickname first keeps it, ties going to the server whose name sorts first.
+// Both servers reach the same verdict, so only the loser's server acts on it.
+func beats(since int64, server string, otherSince int64, otherServer string) bool {
+	if since != otherSince {
+		return since < otherSince
+	}
+	return server < otherServer
+}
+
+// nickInUse reports whether a nickname is taken anywhere in the network or
+// held for a resume, the caller must hold s.mu
+func (s *Server) nickInUse(nickname string) bool {
+	_, local := s.clients[nickname]
+	_, remote := s.remote[nickname]
+	_, held := s.held[nickname]
+	return local || remote || held
+}
+
+// userFrame announces a local user to linked servers, the caller must hold s.mu
+func (s *Server) userFrame(nickname string, client *Client) linkFrame {
+	return linkFrame{Type: "user", Nick: nickname, Server: s.config.ServerName, Since: client.signon.UnixNano()}
+}
+
+// broadcastLinks sends a frame to every linked server except one, the
+// caller must hold s.mu
+func (s *Server) broadcastLinks(f linkFrame, except *Link) {
+	for _, link := range s.links {
+		if link != except {
+			link.send(f)
+		}
+	}
+}
+
+// notifyAll sends a notice to every local user, the caller must hold s.mu
+func (s *Server) notifyAll(notice string) {
+	for nick, client := range s.clients {
+		s.deliver(nick, client, Event{Type: "notice", Body: notice, Time: time.Now()})
+	}
+}
+
+// linkTo returns the link a server is reached through, nil if none of its
+// users are known here, the caller must hold s.mu
+func (s *Server) linkTo(server string) *Link {
+	if link := s.links[server]; link != nil {
+		return link
+	}
+	for _, user := range s.remote {
+		if user.Server == server {
+			return user.link
+		}
+	}
+	return nil
+}
+
+// addLink starts using a link, queueing every user known here for the
+// server at the other end. It refuses a second link to the same server,
+// or one to a server already reached through another link.
+func (s *Server) addLink(link *Link) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing.Load() || link.name == s.config.ServerName || s.linkTo(link.name) != nil {
+		return false
+	}
+
+	link.outCh = make(chan linkFrame, len(s.clients)+len(s.remote)+linkQueue)
+	for nick, client := range s.clients {
+		link.outCh <- s.userFrame(nick, client)
+	}
+	for _, user := range s.remote {
+		link.outCh <- linkFrame{Type: "user", Nick: user.Nickname, Server: user.Server, Since: user.Since}
+	}
+	s.links[link.name] = link
+
+	s.logger.Printf("Linked with server %s", link.name)
+	s.notifyAll(fmt.Sprintf("*** Linked with server %s", link.name))
+	return true
+}
+
+// removeLink handles a netsplit: everyone reached through the link leaves
+// the network, and the other linked servers are told so
+func (s *Server) removeLink(link *Link) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.links, link.name)
+	var lost []string
+	for nick, user := range s.remote {
+		if user.link == link {
+			delete(s.remote, nick)
+			lost = append(lost, nick)
+			s.broadcastLinks(linkFrame{Type: "quit", Nick: nick, Server: user.Server}, nil)
+		}
+	}
+	sort.Strings(lost)
+
+	s.logger.Printf("Lost link with server %s, %d remote users removed", link.name, len(lost))
+	notice := fmt.Sprintf("*** Netsplit: lost link with server %s", link.name)
+	if len(lost) > 0 {
+		notice += fmt.Sprintf(", %d user(s) left: %s", len(lost), strings.Join(lost, ", "))
+	}
+	s.notifyAll(notice)
+}
+
+// handleLinkFrame applies a frame received from a linked server
+func (s *Server) handleLinkFrame(link *Link, f linkFrame) {
+	switch f.Type {
+	case "user":
+		s.mu.Lock()
+
+		// Our own users, or those of a server reached another way, coming
+		// in on this link mean it closed a cycle
+		if route := s.linkTo(f.Server); f.Server == s.config.ServerName || (route != nil && route != link) {
+			s.mu.Unlock()
+			s.logger.Printf("Dropping the link with server %s: it reaches server %s another way", link.name, f.Server)
+			link.conn.Close()
+			return
+		}
+
+		var loser *Client
+		if client, exists := s.clients[f.Nick]; exists {
+			if !beats(f.Since, f.Server, client.signon.UnixNano(), s.config.ServerName) {
+				// Our user keeps the nickname, the other server drops theirs
+				s.mu.Unlock()
+				return
+			}
+			// Our user loses the nickname and leaves its rooms now, its
+			// handler finds the nickname gone and leaves the rest alone
+			s.unregister(f.Nick)
+			loser = client
+		} else if user, exists := s.remote[f.Nick]; exists && user.Server != f.Server {
+			if !beats(f.Since, f.Server, user.Since, user.Server) {
+				s.mu.Unlock()
+				return
+			}
+		}
+		s.remote[f.Nick] = &RemoteUser{Nickname: f.Nick, Server: f.Server, Since: f.Since, link: link}
+		s.broadcastLinks(f, link)
+		s.mu.Unlock()
+
+		if loser != nil {
+			s.logger.Printf("Nickname collision: %s is taken on server %s, disconnecting the local user", f.Nick, f.Server)
+			s.disconnect(loser, fmt.Sprintf("*** Nickname collision: %s was taken first on server %s", f.Nick, f.Server))
+		}
+	case "quit":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// A quit from the loser of a collision is ignored, the winner stays
+		if user, exists := s.remote[f.Nick]; exists && user.Server == f.Server {
+			delete(s.remote, f.Nick)
+			s.broadcastLinks(f, link)
+		}
+	case "msg":
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		ev := Event{Type: "message", From: f.From, To: f.To, Body: f.Body, Time: f.Time}
+		mentioned, words := mentionsOf(f.Body), wordsOf(f.Body)
+		if f.To == "*" {
+			for nick, client := range s.clients {
+				if !client.ignores[f.From] {
+					ev.Tags = highlights(nick, client.highlights, mentioned, words)
+					s.deliver(nick, client, ev)
+				}
+			}
+			s.broadcastLinks(f, link)
+		} else if client, exists := s.clients[f.To]; exists {
+			if !client.ignores[f.From] {
+				ev.Tags = highlights(f.To, client.highlights, mentioned, words)
+				s.deliver(f.To, client, ev)
+			}
+		} else if user, exists := s.remote[f.To]; exists && user.link != link {
+			user.link.send(f)
+		}
+	}
+}
+
+// handleLink serves a connection to another server. The dialing side
+// says hello first, both sides must present the link secret.
+func (s *Server) handleLink(conn net.Conn, dialed bool) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	hello := linkFrame{Type: "hello", Server: s.config.ServerName, Secret: s.config.LinkSecret}
+
+	if dialed {
+		encoder.Encode(hello)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var peer linkFrame
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &peer) != nil || peer.Type != "hello" || peer.Server == "" {
+		s.logger.Printf("Link from %s failed: no hello", conn.RemoteAddr())
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(peer.Secret), []byte(s.config.LinkSecret)) != 1 {
+		s.logger.Printf("Link from %s (%s) refused: wrong secret", conn.RemoteAddr(), peer.Server)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if !dialed {
+		encoder.Encode(hello)
+	}
+
+	link := &Link{name: peer.Server, conn: conn}
+	if !s.addLink(link) {
+		s.logger.Printf("Link from %s (%s) refused: already linked or reached through another link", conn.RemoteAddr(), peer.Server)
+		return
+	}
+	defer s.removeLink(link)
+
+	// Write queued frames until the link goes down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case f := <-link.outCh:
+				if s.config.WriteTimeout > 0 {
+					conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+				}
+				if err := encoder.Encode(f); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for scanner.Scan() {
+		var f linkFrame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			s.logger.Printf("Bad frame from server %s: %v", link.name, err)
+			continue
+		}
+		s.handleLinkFrame(link, f)
+	}
+}
+
+// maintainLink keeps a link to another server up, redialing whenever it
+// drops, until the server shuts down
+func (s *Server) maintainLink(address string) {
+	for {
+		conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+		if err != nil {
+			s.logger.Printf("Failed to link with %s: %v", address, err)
+		} else {
+			s.handleLink(conn, true)
+		}
+
+		if s.closing.Load() {
+			return
+		}
+		time.Sleep(s.config.LinkRetry)
+	}
+}
+
+// serveLinks accepts links from other servers until the listener is closed
+func serveLinks(server *Server, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			server.logger.Printf("Error accepting link: %v", err)
+			continue
+		}
+
+		go server.handleLink(conn, false)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OfflineMessage is a message held for a user who is not connected
+type OfflineMessage struct {
+	ID   string    `json:"id,omitempty"`
+	From string    `json:"from"`
+	Body string    `json:"body"`
+	Time time.Time `json:"time"`
+}
+
+// Mention is a room message or broadcast that mentioned a user while they were offline
+type Mention struct {
+	From string    `json:"from"`
+	To   string    `json:"to"` // Rooms the message went to, or * for everyone
+	Body string    `json:"body"`
+	Time time.Time `json:"time"`
+}
+
+// Mailbox stores messages for known nicknames while they are offline
+type Mailbox struct {
+	mu       sync.Mutex                  // mutex to protect known, queues and mentions
+	path     string                      // File the mailbox is persisted to
+	limit    int                         // Maximum number of queued messages, and of mentions, per user
+	ttl      time.Duration               // How long a queued message is kept
+	known    map[string]bool             // Nicknames that have registered before
+	queues   map[string][]OfflineMessage // map of nicknames to queued messages
+	mentions map[string][]Mention        // map of nicknames to mentions for their digest
+}
+
+// mailboxFile is the on-disk format of a mailbox
+type mailboxFile struct {
+	Known    []string                    `json:"known"`
+	Queues   map[string][]OfflineMessage `json:"queues"`
+	Mentions map[string][]Mention        `json:"mentions,omitempty"`
+}
+
+// NewMailbox creates a mailbox, loading any state previously saved at path
+func NewMailbox(path string, limit int, ttl time.Duration) (*Mailbox, error) {
+	m := &Mailbox{
+		path:     path,
+		limit:    limit,
+		ttl:      ttl,
+		known:    make(map[string]bool),
+		queues:   make(map[string][]OfflineMessage),
+		mentions: make(map[string][]Mention),
+	}
+
+	var file mailboxFile
+	if err := readJSONFile(path, &file); err != nil {
+		return nil, err
+	}
+	for _, nick := range file.Known {
+		m.known[nick] = true
+	}
+	for nick, queue := range file.Queues {
+		m.queues[nick] = queue
+	}
+	for nick, mentions := range file.Mentions {
+		m.mentions[nick] = mentions
+	}
+	return m, nil
+}
+
+// Errors returned by the mailbox when it won't take a message
+var (
+	ErrUnknownNickname = errors.New("unknown nickname")
+	ErrMailboxFull     = errors.New("mailbox full")
+)
+
+// MarkKnown records that a nickname has registered, so messages to it can be queued
+func (m *Mailbox) MarkKnown(nickname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.known[nickname] {
+		return nil
+	}
+	m.known[nickname] = true
+	return m.save()
+}
+
+// Enqueue queues a message for an offline nickname. A message that can't
+// be saved to disk is not queued at all, so the sender is never told a
+// message was kept when a restart would lose it.
+func (m *Mailbox) Enqueue(nickname, id, from, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.known[nickname] {
+		return ErrUnknownNickname
+	}
+
+	queue := m.expire(m.queues[nickname])
+	if len(queue) >= m.limit {
+		m.queues[nickname] = queue
+		return ErrMailboxFull
+	}
+
+	m.queues[nickname] = append(queue, OfflineMessage{ID: id, From: from, Body: body, Time: time.Now()})
+	if err := m.save(); err != nil {
+		m.queues[nickname] = queue
+		return err
+	}
+	return nil
+}
+
+// Take removes and returns the unexpired messages queued for a nickname,
+// oldest first. The messages are returned even if the mailbox couldn't be
+// saved without them.
+func (m *Mailbox) Take(nickname string) ([]OfflineMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queue, exists := m.queues[nickname]
+	if !exists {
+		return nil, nil
+	}
+	delete(m.queues, nickname)
+	return m.expire(queue), m.save()
+}
+
+// Restore puts messages back at the front of a nickname's queue
+func (m *Mailbox) Restore(nickname string, messages []OfflineMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queues[nickname] = append(messages, m.queues[nickname]...)
+	return m.save()
+}
+
+// AddMention keeps a mention for a known nickname's digest, failing if the
+// nickname is unknown or already has as many mentions as it may
+func (m *Mailbox) AddMention(nickname string, mention Mention) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.known[nickname] {
+		return ErrUnknownNickname
+	}
+
+	mentions := m.expireMentions(m.mentions[nickname])
+	if len(mentions) >= m.limit {
+		m.mentions[nickname] = mentions
+		return ErrMailboxFull
+	}
+
+	m.mentions[nickname] = append(mentions, mention)
+	if err := m.save(); err != nil {
+		m.mentions[nickname] = mentions
+		return err
+	}
+	return nil
+}
+
+// TakeMentions removes and returns the unexpired mentions of a nickname,
+// oldest first, even if the mailbox couldn't be saved without them
+func (m *Mailbox) TakeMentions(nickname string) ([]Mention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mentions, exists := m.mentions[nickname]
+	if !exists {
+		return nil, nil
+	}
+	delete(m.mentions, nickname)
+	return m.expireMentions(mentions), m.save()
+}
+
+// expireMentions drops mentions older than the mailbox TTL, the caller must hold m.mu
+func (m *Mailbox) expireMentions(mentions []Mention) []Mention {
+	cutoff := time.Now().Add(-m.ttl)
+	for len(mentions) > 0 && mentions[0].Time.Before(cutoff) {
+		mentions = mentions[1:]
+	}
+	return mentions
+}
+
+// expire drops messages older than the mailbox TTL, the caller must hold m.mu
+func (m *Mailbox) expire(queue []OfflineMessage) []OfflineMessage {
+	cutoff := time.Now().Add(-m.ttl)
+	for len(queue) > 0 && queue[0].Time.Before(cutoff) {
+		queue = queue[1:]
+	}
+	return queue
+}
+
+// save writes the mailbox to disk, the caller must hold m.mu
+func (m *Mailbox) save() error {
+	file := mailboxFile{Queues: m.queues, Mentions: m.mentions}
+	for nick := range m.known {
+		file.Known = append(file.Known, nick)
+	}
+	sort.Strings(file.Known)
+	return writeJSONFile(m.path, file)
+}
@@ -2,37 +2,781 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Client stands for a chat client
 type Client struct {
 	conn     net.Conn    // TCP connection between client and server
-	nickname string      // User nickname
-	outCh    chan string // Channel to send messages
+	nickname string      // User nickname, empty until one is taken; protected by the server mutex
+	account  string      // Account the client has identified as, empty if none; written under the server mutex
+	outCh    chan Event  // Channel to send messages
+	fileCh   chan Event  // Channel for file transfer chunks, written only when outCh is empty
+	spill    *SpillQueue // Overflow queue on disk, nil unless the spill policy is used
+	jsonMode atomic.Bool // Client speaks the JSON frame protocol instead of text
+
+	outMu     sync.RWMutex // Held for reading to send on outCh, for writing to close it
+	outClosed bool         // outCh is closed, nothing may be sent on it; protected by outMu
+
+	connectedAt time.Time    // When the connection was accepted
+	lastActive  atomic.Int64 // When the client last sent a command, in Unix nanoseconds
+	signon      time.Time    // When the client took its nickname, settles collisions with other servers; protected by the server mutex
+	since       time.Time    // When the user took its nickname, kept across a resume, the start of its history; protected by the server mutex
+	away        string       // Away message, empty while the user is present; protected by the server mutex
+	awaySince   time.Time    // When the user went away; protected by the server mutex
+
+	ignores    map[string]bool // Nicknames whose messages the user doesn't want; protected by the server mutex
+	highlights []string        // Keywords that highlight a message for the user, in lower case; protected by the server mutex
+
+	resumeToken string      // Secret that lets a new connection take over this session; protected by the server mutex
+	noResume    atomic.Bool // The client quit or was thrown out, so its nickname is not held for it
+
+	bot *BotClient // Set for a server-side bot, which has no connection
+
+	operator   atomic.Bool // Operator status granted at runtime with /OP
+	limits     rateLimits  // Message budgets of this connection
+	violations []time.Time // Recent rate limit violations, used to disconnect flooders
+
+	identifyFailures int // Wrong /IDENTIFY passwords given on this connection, used to disconnect guessers
+
+	writeTimeout time.Duration // How long a write may take before the connection is considered dead
+	pingSeq      atomic.Int64  // Token of the last PING sent
+	missedPings  atomic.Int32  // PINGs sent since the client last sent a line
+
+	quit chan struct{} // Closed at shutdown to make the writer flush and stop
+	done chan struct{} // Closed by the writer goroutine when it stops
+
+	dropped   atomic.Int64 // Messages dropped because the client was too slow
+	spilled   atomic.Int64 // Messages written to the overflow queue
+	overflows atomic.Int64 // Times a message found outCh full
+}
+
+// TokenBucket is a rate limiter that refills at a steady rate and allows bursts up to its capacity
+type TokenBucket struct {
+	mu     sync.Mutex // mutex to protect tokens and last
+	rate   float64    // Tokens added per second, 0 means unlimited
+	burst  float64    // Maximum number of tokens
+	tokens float64    // Tokens currently available
+	last   time.Time  // When tokens was last brought up to date
+}
+
+// NewTokenBucket creates a full bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take removes a token if one is available, otherwise it reports how
+// long it will be until the next token arrives
+func (b *TokenBucket) Take() (bool, time.Duration) {
+	if b.rate <= 0 {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Refund gives back a token taken by Take
+func (b *TokenBucket) Refund() {
+	if b.rate <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// Full reports whether the bucket has refilled, leaving it no different from a new one
+func (b *TokenBucket) Full() bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.burst
+}
+
+// limitsSweep is how often refilled nickname budgets are dropped
+const limitsSweep = time.Minute
+
+// rateLimits holds separate budgets for direct messages and broadcasts
+type rateLimits struct {
+	dm        *TokenBucket // Messages to nicknames
+	broadcast *TokenBucket // Messages to * or to rooms
+}
+
+// newRateLimits creates full budgets from the server settings
+func newRateLimits(config Config) rateLimits {
+	return rateLimits{
+		dm:        NewTokenBucket(config.DMRate, config.DMBurst),
+		broadcast: NewTokenBucket(config.BroadcastRate, config.BroadcastBurst),
+	}
+}
+
+// full reports whether both budgets have refilled
+func (l rateLimits) full() bool {
+	return l.dm.Full() && l.broadcast.Full()
+}
+
+// bucket picks the budget a message is charged to
+func (l rateLimits) bucket(broadcast bool) *TokenBucket {
+	if broadcast {
+		return l.broadcast
+	}
+	return l.dm
+}
+
+// Event is pushed to a client outside of command replies, such as an incoming message
+type Event struct {
+	Type    string    `json:"type"`              // "message", "notice", "ping", "resume", "delivered", "read", one of the "file-" events, or "join" and "leave" for bots
+	ID      string    `json:"id,omitempty"`      // Message the event is or acknowledges, assigned by SendMessage
+	From    string    `json:"from,omitempty"`    // Sender of a message
+	To      string    `json:"to,omitempty"`      // Recipient nickname, "*" for broadcasts, or a room
+	Body    string    `json:"body"`              // Message or notice text
+	Time    time.Time `json:"time"`              // When the event happened
+	Offline bool      `json:"offline,omitempty"` // Message was held while the recipient was offline
+	Tags    []string  `json:"tags,omitempty"`    // Mention of the recipient and keywords of theirs the message matched
+	File    *FileInfo `json:"file,omitempty"`    // Transfer the event is about
+}
+
+// FileInfo describes a file transfer in an event
+type FileInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Data   string `json:"data,omitempty"`   // Base64 encoded chunk, in file-data events
+	SHA256 string `json:"sha256,omitempty"` // Checksum of the whole file, in file-done events
+}
+
+// text renders an event for the plain text protocol
+func (e Event) text() string {
+	if e.Type == "message" && len(e.Tags) > 0 {
+		// Marked so text clients can alert the user
+		e.Tags = nil
+		return "! " + e.text()
+	}
+
+	switch {
+	case e.Type == "notice":
+		return e.Body
+	case e.Type == "ping":
+		return "PING " + e.Body
+	case e.Type == "resume":
+		return "RESUME " + e.Body
+	case e.Type == "delivered":
+		return fmt.Sprintf("*** Message %s delivered to %s", e.ID, e.From)
+	case e.Type == "read":
+		return fmt.Sprintf("*** %s read message %s", e.From, e.ID)
+	case strings.HasPrefix(e.Type, "file-"):
+		return e.fileText()
+	case e.Offline:
+		return fmt.Sprintf("%s (offline, %s): %s", e.From, e.Time.Format(time.DateTime), e.Body)
+	case strings.HasPrefix(e.To, "#"):
+		return fmt.Sprintf("[%s] %s: %s", e.To, e.From, e.Body)
+	default:
+		return fmt.Sprintf("%s: %s", e.From, e.Body)
+	}
+}
+
+// fileText renders a transfer event as a FILE line, which clients parse
+func (e Event) fileText() string {
+	f := e.File
+	switch e.Type {
+	case "file-offer":
+		return fmt.Sprintf("FILE OFFER %s %s %s %d (/ACCEPT %s or /REJECT %s)", f.ID, e.From, f.Name, f.Size, f.ID, f.ID)
+	case "file-accepted":
+		return fmt.Sprintf("FILE ACCEPTED %s %s %s", f.ID, e.From, f.Name)
+	case "file-rejected":
+		return fmt.Sprintf("FILE REJECTED %s %s %s", f.ID, e.From, f.Name)
+	case "file-data":
+		return fmt.Sprintf("FILE DATA %s %s", f.ID, f.Data)
+	case "file-done":
+		return fmt.Sprintf("FILE DONE %s %s", f.ID, f.SHA256)
+	default:
+		return fmt.Sprintf("FILE ABORTED %s %s", f.ID, e.Body)
+	}
+}
+
+// Reply is the server's answer to a command
+type Reply struct {
+	Status  int            `json:"status"`            // Status code, one of the Status constants
+	Message string         `json:"message"`           // Human readable text, all a text client sees
+	Success []string       `json:"success,omitempty"` // Recipients a message was delivered to
+	Queued  []string       `json:"queued,omitempty"`  // Recipients a message was queued for
+	Failed  []string       `json:"failed,omitempty"`  // Recipients a message could not reach
+	Data    map[string]any `json:"data,omitempty"`    // Command specific fields
+}
+
+// Status codes of replies, modelled on HTTP
+const (
+	StatusOK           = 200 // Command succeeded
+	StatusPartial      = 207 // Message reached only some of its recipients
+	StatusBadRequest   = 400 // Malformed, unknown or refused command
+	StatusUnauthorized = 401 // A nickname or identification is required
+	StatusForbidden    = 403 // Refused by moderation or missing operator rights
+	StatusNotFound     = 404 // No such user, room or recipient
+	StatusTooMany      = 429 // Rate limited
+	StatusUnavailable  = 503 // Server could not carry out the command
+)
+
+// okReply builds a successful reply
+func okReply(format string, args ...any) Reply {
+	return Reply{Status: StatusOK, Message: fmt.Sprintf(format, args...)}
+}
+
+// errReply builds a failed reply with the given status
+func errReply(status int, format string, args ...any) Reply {
+	return Reply{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// newReply turns the (bool, string) result of a Server method into a reply
+func newReply(success bool, message string) Reply {
+	if success {
+		return Reply{Status: StatusOK, Message: message}
+	}
+	return Reply{Status: StatusBadRequest, Message: message}
+}
+
+// request is a command in the JSON frame protocol, args are joined with
+// spaces so {"command": "MSG", "args": ["bob", "hi there"]} is /MSG bob hi there
+type request struct {
+	ID      string   `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// replyFrame is a reply in the JSON frame protocol
+type replyFrame struct {
+	Type    string `json:"type"`         // Always "reply", events carry their own type
+	ID      string `json:"id,omitempty"` // Id of the request being answered
+	Command string `json:"command"`      // Command being answered
+	Reply
+}
+
+// writeEvent writes an event to the connection in the client's protocol
+func (c *Client) writeEvent(ev Event) error {
+	var line []byte
+	if c.jsonMode.Load() {
+		line, _ = json.Marshal(ev)
+	} else {
+		line = []byte(ev.text())
+	}
+	return c.write(line)
+}
+
+// writeReply writes the reply to a command in the client's protocol
+func (c *Client) writeReply(id, command string, reply Reply) error {
+	var line []byte
+	if c.jsonMode.Load() {
+		line, _ = json.Marshal(replyFrame{Type: "reply", ID: id, Command: command, Reply: reply})
+	} else {
+		line = []byte(reply.Message)
+	}
+	return c.write(line)
+}
+
+// address returns where the client is connected from, "bot" for a bot
+func (c *Client) address() string {
+	if c.bot != nil {
+		return "bot"
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// close hangs up on the client, which makes its handler unregister it
+func (c *Client) close() {
+	if c.bot != nil {
+		c.bot.stop()
+		return
+	}
+	c.conn.Close()
+}
+
+// offer queues an event on outCh, waiting up to timeout for room. It
+// reports whether the event was queued and whether outCh is still open.
+func (c *Client) offer(ev Event, timeout time.Duration) (bool, bool) {
+	c.outMu.RLock()
+	defer c.outMu.RUnlock()
+
+	if c.outClosed {
+		return false, false
+	}
+	select {
+	case c.outCh <- ev:
+		return true, true
+	default:
+	}
+	if timeout <= 0 {
+		return false, true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.outCh <- ev:
+		return true, true
+	case <-timer.C:
+		return false, true
+	}
+}
+
+// closeOut closes outCh once no sender is using it, which makes the
+// writer stop after writing what is queued
+func (c *Client) closeOut() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if !c.outClosed {
+		c.outClosed = true
+		close(c.outCh)
+	}
+}
+
+// write sends one line, giving up after the write timeout so a dead peer
+// can't block the writer forever
+func (c *Client) write(line []byte) error {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(append(line, "\r\n"...))
+	return err
+}
+
+// pong handles a PONG, the client is alive if it echoes a token it was sent,
+// late answers to earlier PINGs included
+func (c *Client) pong(token string) {
+	if seq, err := strconv.ParseInt(token, 10, 64); err == nil && seq > 0 && seq <= c.pingSeq.Load() {
+		c.missedPings.Store(0)
+	}
+}
+
+// SpillQueue is a bounded, disk-backed queue of messages for a slow client
+type SpillQueue struct {
+	mu     sync.Mutex    // mutex to protect the files and count
+	path   string        // File the queued messages are stored in
+	limit  int           // Maximum number of queued messages
+	file   *os.File      // Handle messages are appended through
+	reader *bufio.Reader // Reader positioned at the oldest queued message
+	source *os.File      // Handle the reader reads from
+	count  int           // Number of queued messages
+	ready  chan struct{} // Signalled when a message is queued
+}
+
+// NewSpillQueue creates an empty spill queue stored at path
+func NewSpillQueue(path string, limit int) (*SpillQueue, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &SpillQueue{
+		path:   path,
+		limit:  limit,
+		file:   file,
+		reader: bufio.NewReader(source),
+		source: source,
+		ready:  make(chan struct{}, 1),
+	}, nil
+}
+
+// Push appends a message to the queue, returning false if it is full
+func (q *SpillQueue) Push(ev Event) bool {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count >= q.limit {
+		return false
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return false
+	}
+	q.count++
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop removes and returns the oldest message in the queue
+func (q *SpillQueue) Pop() (Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		return Event{}, false
+	}
+	line, err := q.reader.ReadBytes('\n')
+	if err != nil {
+		return Event{}, false
+	}
+	q.count--
+
+	// Start over with an empty file once everything has been read
+	if q.count == 0 {
+		q.file.Truncate(0)
+		q.source.Seek(0, io.SeekStart)
+		q.reader.Reset(q.source)
+	}
+
+	var ev Event
+	if err := json.Unmarshal(line, &ev); err != nil {
+		return Event{}, false
+	}
+	return ev, true
+}
+
+// Len returns the number of queued messages
+func (q *SpillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Close closes and deletes the queue file
+func (q *SpillQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.file.Close()
+	q.source.Close()
+	os.Remove(q.path)
+}
+
+// readJSONFile loads a JSON file into v, a missing file leaves v untouched
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile saves v as JSON, writing to a temporary file first so
+// a crash never leaves a partially written file behind
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Config holds the tunable settings of a server
+type Config struct {
+	DataDir    string        // Directory where server state is persisted
+	MailboxCap int           // Maximum number of offline messages kept per user
+	MailboxTTL time.Duration // How long offline messages are kept
+
+	ReserveNicks bool // Only the owner of a registered nickname may use it
+
+	HistoryMaxSize int64 // Size in bytes at which the chat log is rotated
+	HistoryKeep    int   // Number of rotated chat logs to keep
+
+	IgnoreMode IgnoreMode // What the sender of a message to a user ignoring them is told
+
+	SlowPolicy   SlowPolicy    // What to do when a client's outCh is full
+	BlockTimeout time.Duration // How long the block policy waits for room in outCh
+	SpillLimit   int           // Maximum messages in a client's overflow queue
+	MaxOverflows int64         // Overflows before the disconnect policy drops a client
+
+	DMRate         float64 // Direct messages per second allowed, 0 for no limit
+	DMBurst        int     // Direct messages allowed in a burst
+	BroadcastRate  float64 // Broadcasts and room messages per second allowed, 0 for no limit
+	BroadcastBurst int     // Broadcasts and room messages allowed in a burst
+	MaxViolations  int     // Rate limit violations in a minute before a client is disconnected
+
+	OpsFile string // File listing the accounts that are operators
+
+	PingInterval   time.Duration // How often clients are sent a keepalive PING, 0 disables keepalives
+	MaxMissedPings int32         // Unanswered PINGs before a client is disconnected
+	ReadTimeout    time.Duration // How long a client may send nothing at all before it is dropped, 0 for no limit
+	WriteTimeout   time.Duration // How long a write to a client may take, 0 for no limit
+
+	ServerName string        // Name of this server in the network
+	LinkSecret string        // Password linked servers must present
+	LinkRetry  time.Duration // How long to wait before redialing a lost link
+
+	MaxFileSize int64 // Largest file that may be sent, in bytes
+
+	ResumeGrace time.Duration // How long a dropped user's nickname is held for a resume, 0 disables resuming
+}
+
+// IgnoreMode decides how a message to a user who ignores its sender is reported
+type IgnoreMode string
+
+const (
+	IgnoreDrop IgnoreMode = "drop" // Report the message as sent and drop it
+	IgnoreFail IgnoreMode = "fail" // Report the recipient as failed
+)
+
+// SlowPolicy decides what happens to a message when a client's outCh is full
+type SlowPolicy string
+
+const (
+	PolicyDrop       SlowPolicy = "drop"       // Drop the message
+	PolicyBlock      SlowPolicy = "block"      // Make the sender wait up to BlockTimeout, then drop; notices don't wait
+	PolicySpill      SlowPolicy = "spill"      // Queue the message on disk
+	PolicyDisconnect SlowPolicy = "disconnect" // Drop, and disconnect after MaxOverflows
+)
+
+// ClientStats is a snapshot of a client's delivery counters
+type ClientStats struct {
+	Queued    int   `json:"queued"`    // Messages waiting in outCh
+	Capacity  int   `json:"capacity"`  // Size of outCh
+	OnDisk    int   `json:"on_disk"`   // Messages waiting in the overflow queue
+	Dropped   int64 `json:"dropped"`   // Messages dropped
+	Spilled   int64 `json:"spilled"`   // Messages written to the overflow queue
+	Overflows int64 `json:"overflows"` // Times a message found outCh full
+}
+
+// Presence describes a connected user for /WHOIS and /LIST
+type Presence struct {
+	Nickname    string    `json:"nickname"`
+	Server      string    `json:"server,omitempty"`       // Server the user is connected to, empty for this one
+	Status      string    `json:"status"`                 // "online" or "away"
+	AwayMessage string    `json:"away_message,omitempty"` // Why the user is away
+	AwaySince   time.Time `json:"away_since,omitzero"`    // When the user went away
+	Account     string    `json:"account,omitempty"`      // Account the user has identified as
+	Address     string    `json:"address,omitempty"`      // Remote address of the connection
+	Connected   time.Time `json:"connected"`              // When the user connected
+	LastActive  time.Time `json:"last_active,omitzero"`   // When the user last sent a command
+}
+
+// presence describes a client, the caller must hold s.mu
+func presence(nickname string, client *Client) Presence {
+	p := Presence{
+		Nickname:   nickname,
+		Status:     "online",
+		Account:    client.account,
+		Address:    client.address(),
+		Connected:  client.connectedAt,
+		LastActive: time.Unix(0, client.lastActive.Load()),
+	}
+	if client.away != "" {
+		p.Status = "away"
+		p.AwayMessage = client.away
+		p.AwaySince = client.awaySince
+	}
+	return p
+}
+
+// HeldSession keeps a dropped user's nickname and messages for a while,
+// so the client can reconnect and resume without losing either
+type HeldSession struct {
+	Nickname string
+	Account  string    // Account the user had identified as
+	Rooms    []string  // Rooms to rejoin on resume
+	Queue    []Event   // Messages sent to the user while away, see mu
+	Expires  time.Time // End of the grace period
+	token    string    // Resume token the client must present
+
+	ignores    map[string]bool // The user's ignore list, handed back on resume
+	highlights []string        // The user's highlight keywords, likewise
+	since      time.Time       // When the user took the nickname, likewise
+
+	mu sync.Mutex // protects Queue from senders, which only hold the server's read lock
 }
 
 // Server to manage clients and connections
 type Server struct {
-	mu      sync.RWMutex        // mutex to protect clients map
-	clients map[string]*Client  // map of usernames to clients
-	logger  *log.Logger         // logger for server
+	mu      sync.RWMutex       // mutex to protect clients and rooms maps
+	clients map[string]*Client // map of usernames to clients
+	rooms   map[string]*Room   // map of room names to rooms
+	mailbox *Mailbox           // messages waiting for offline users
+	logger  *log.Logger        // logger for server
+
+	accounts *AccountStore // registered nicknames
+	history  *History      // log of routed messages
+	config   Config        // tunable settings
+
+	operators map[string]bool      // accounts listed in the operators file
+	bans      *BanList             // banned nicknames and IP addresses
+	filters   *FilterList          // patterns messages are checked against
+	mutes     map[string]time.Time // muted nicknames and when the mute ends, zero for never
+
+	limitsMu    sync.Mutex            // mutex to protect nickLimits and limitsSwept
+	nickLimits  map[string]rateLimits // message budgets per nickname, kept across reconnects until refilled
+	limitsSwept time.Time             // when refilled budgets were last dropped from nickLimits
+
+	links  map[string]*Link       // linked servers by name
+	remote map[string]*RemoteUser // users on other servers by nickname
+
+	held map[string]*HeldSession // sessions of dropped users waiting to be resumed, by nickname
+	bots map[string]*BotClient   // server-side bots, by nickname, also in clients
+
+	transfersMu    sync.Mutex           // mutex to protect transfers, never held while taking s.mu
+	transfers      map[string]*Transfer // file transfers in progress by id
+	nextTransferID atomic.Uint64        // used to number transfers
+
+	conns    map[*Client]struct{} // every open connection, with or without a nickname
+	handlers sync.WaitGroup       // running connection handlers
+	closing  atomic.Bool          // set once shutdown has started
+
+	nextConnID atomic.Uint64 // used to name per-connection files
+
+	nextMessageID atomic.Uint64       // used to number routed messages
+	receiptsMu    sync.Mutex          // mutex to protect receipts and receiptOrder, never held while taking s.mu
+	receipts      map[string]*receipt // direct messages that may still be read, by id
+	receiptOrder  []string            // ids in receipts, oldest first, for expiry, see compactReceipts
+
+	commands *CommandRegistry // commands users can send, built-in and added
+	metrics  *Metrics         // counters for the admin endpoint
+	started  time.Time        // when the server was created
+}
+
+// ShutdownSummary reports how a shutdown went
+type ShutdownSummary struct {
+	Connections int           // Connections open when shutdown started
+	Users       int           // Connections that had a nickname
+	Flushed     int           // Queued messages written before the connections closed
+	Unsent      int           // Queued messages abandoned at the deadline
+	TimedOut    int           // Connections that did not flush in time
+	Duration    time.Duration // How long the shutdown took
+}
+
+// SendResult reports what happened to each recipient of SendMessage
+type SendResult struct {
+	ID      string   // ID assigned to the message, empty if it was rejected
+	Success []string // Recipients the message was delivered to
+	Queued  []string // Offline recipients the message was queued for
+	Failed  []string // Recipients the message could not be delivered to
+
+	Rejected string // Why the whole message was refused, empty if it was not
 }
 
 // NewServer creates a new server instance
-func NewServer(logger *log.Logger) *Server {
+func NewServer(logger *log.Logger, config Config) (*Server, error) {
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	mailbox, err := NewMailbox(filepath.Join(config.DataDir, "mailbox.json"), config.MailboxCap, config.MailboxTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := NewAccountStore(filepath.Join(config.DataDir, "accounts.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := NewHistory(filepath.Join(config.DataDir, "history.log"), config.HistoryMaxSize, config.HistoryKeep)
+	if err != nil {
+		return nil, err
+	}
+
+	operators, err := loadOperators(config.OpsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bans, err := NewBanList(filepath.Join(config.DataDir, "bans.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := NewFilterList(filepath.Join(config.DataDir, "filters.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SlowPolicy == PolicySpill {
+		// Overflow queues belong to connections, so leftovers from a previous run are stale
+		spillDir := filepath.Join(config.DataDir, "spill")
+		os.RemoveAll(spillDir)
+		if err := os.MkdirAll(spillDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	commands := NewCommandRegistry()
+	for _, cmd := range builtinCommands() {
+		if err := commands.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+
 	return &Server{
 		clients: make(map[string]*Client),
-		logger:  logger,
-	}
+		rooms:   make(map[string]*Room),
+		conns:   make(map[*Client]struct{}),
+		links:   make(map[string]*Link),
+		remote:  make(map[string]*RemoteUser),
+
+		held:      make(map[string]*HeldSession),
+		bots:      make(map[string]*BotClient),
+		transfers: make(map[string]*Transfer),
+		receipts:  make(map[string]*receipt),
+
+		nickLimits: make(map[string]rateLimits),
+		operators:  operators,
+		bans:       bans,
+		filters:    filters,
+		mutes:      make(map[string]time.Time),
+		mailbox:    mailbox,
+		logger:     logger,
+		accounts:   accounts,
+		history:    history,
+		config:     config,
+		commands:   commands,
+		metrics:    NewMetrics(),
+		started:    time.Now(),
+	}, nil
 }
 
 // RegisterClient registers a new client with the server
@@ -43,86 +787,674 @@ func (s *Server) RegisterClient(nickname string, client *Client) (bool, string)
 		return false, "Invalid nickname format"
 	}
 
-	// Lock the clients map to prevent concurrent access   
+	if ban, banned := s.bans.Check(nickname); banned {
+		return false, ban.describe()
+	}
+
+	if reason := s.reserved(nickname, client); reason != "" {
+		return false, reason
+	}
+
+	// Lock the clients map to prevent concurrent access
+	s.mu.Lock()
+
+	// Check if the nickname is already in use, here or elsewhere in the network
+	if s.nickInUse(nickname) {
+		s.mu.Unlock()
+		return false, fmt.Sprintf("Nickname %s already in use", nickname)
+	}
+
+	s.clients[nickname] = client
+	client.nickname = nickname
+	client.signon = time.Now()
+	client.since = client.signon
+	s.broadcastLinks(s.userFrame(nickname, client), nil)
+	s.issueResumeToken(nickname, client)
+	s.notifyBots("join", nickname, nil)
+	s.mu.Unlock()
+	s.logger.Printf("User registered with nickname: %s", nickname)
+
+	if err := s.mailbox.MarkKnown(nickname); err != nil {
+		s.logger.Printf("Failed to save the mailbox: %v", err)
+	}
+	if n := s.deliverOffline(nickname, client); n > 0 {
+		return true, fmt.Sprintf("Nickname %s registered successfully, %d offline message(s) delivered", nickname, n)
+	}
+	return true, fmt.Sprintf("Nickname %s registered successfully", nickname)
+}
+
+// deliverOffline sends the messages queued for a nickname to its new client,
+// in the order they were sent, and returns how many were delivered
+func (s *Server) deliverOffline(nickname string, client *Client) int {
+	messages, err := s.mailbox.Take(nickname)
+	if err != nil {
+		s.logger.Printf("Failed to save the mailbox: %v", err)
+	}
+	for i, m := range messages {
+		ev := Event{Type: "message", ID: m.ID, From: m.From, To: nickname, Body: m.Body, Time: m.Time, Offline: true}
+		if sent, _ := client.offer(ev, 5*time.Second); !sent {
+			// The client isn't reading, keep the rest for next time
+			if err := s.mailbox.Restore(nickname, messages[i:]); err != nil {
+				s.logger.Printf("Failed to save the mailbox: %v", err)
+			}
+			s.logger.Printf("Delivered %d of %d offline messages to %s", i, len(messages), nickname)
+			return i
+		}
+	}
+	if len(messages) > 0 {
+		s.logger.Printf("Delivered %d offline messages to %s", len(messages), nickname)
+	}
+	s.deliverMentions(nickname, client)
+	return len(messages)
+}
+
+// UnregisterClient removes a client from the server
+func (s *Server) UnregisterClient(nickname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unregister(nickname)
+}
+
+// unregister removes a user from the server and from every room, returning
+// the rooms the user was in, the caller must hold s.mu
+func (s *Server) unregister(nickname string) []string {
+	if _, exists := s.clients[nickname]; exists {
+		delete(s.clients, nickname)
+		s.broadcastLinks(linkFrame{Type: "quit", Nick: nickname, Server: s.config.ServerName}, nil)
+		s.logger.Printf("User %s left the chat", nickname)
+		s.notifyBots("leave", nickname, nil)
+	}
+	s.cancelTransfers(nickname, fmt.Sprintf("%s left", nickname))
+
+	// Remove the user from every room, deleting rooms left empty
+	var rooms []string
+	for name, room := range s.rooms {
+		if _, member := room.members[nickname]; !member {
+			continue
+		}
+		rooms = append(rooms, name)
+		delete(room.members, nickname)
+		if len(room.members) == 0 {
+			delete(s.rooms, name)
+			s.logger.Printf("Room %s closed", name)
+		} else {
+			s.notifyRoom(room, "", fmt.Sprintf("*** %s left %s", nickname, name))
+			s.notifyBots("leave", nickname, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// issueResumeToken gives a client a new secret for resuming its session
+// after a dropped connection, the caller must hold s.mu
+func (s *Server) issueResumeToken(nickname string, client *Client) {
+	if s.config.ResumeGrace <= 0 {
+		return
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	client.resumeToken = hex.EncodeToString(token)
+	s.deliver(nickname, client, Event{Type: "resume", Body: client.resumeToken, Time: time.Now()})
+}
+
+// Detach handles a closed connection. A user whose connection dropped keeps
+// the nickname for the grace period, collecting direct messages, so a
+// reconnecting client can resume. Users who quit or were thrown out leave
+// for good.
+func (s *Server) Detach(nickname string, client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The nickname may already have been taken from the client, e.g. by a collision
+	if s.clients[nickname] != client {
+		return
+	}
+	if s.config.ResumeGrace <= 0 || client.noResume.Load() || s.closing.Load() || client.resumeToken == "" {
+		s.unregister(nickname)
+		return
+	}
+	s.hold(nickname, client)
+}
+
+// hold unregisters a user and keeps its nickname, rooms and incoming
+// messages for the grace period, the caller must hold s.mu
+func (s *Server) hold(nickname string, client *Client) *HeldSession {
+	held := &HeldSession{
+		Nickname: nickname,
+		Account:  client.account,
+		Expires:  time.Now().Add(s.config.ResumeGrace),
+		token:    client.resumeToken,
+		ignores:  client.ignores,
+
+		highlights: client.highlights,
+		since:      client.since,
+	}
+	held.Rooms = s.unregister(nickname)
+	s.held[nickname] = held
+	s.logger.Printf("Holding %s for %v to allow a resume", nickname, s.config.ResumeGrace)
+
+	time.AfterFunc(s.config.ResumeGrace, func() {
+		if moved, released := s.releaseHeld(nickname, held); released {
+			s.logger.Printf("Resume grace for %s expired, %d message(s) moved to the mailbox", nickname, moved)
+		}
+	})
+	return held
+}
+
+// releaseHeld ends a held session unless it was resumed or released already,
+// returning how many of the messages it collected were moved to the mailbox
+func (s *Server) releaseHeld(nickname string, held *HeldSession) (int, bool) {
+	s.mu.Lock()
+	if s.held[nickname] != held {
+		s.mu.Unlock()
+		return 0, false
+	}
+	delete(s.held, nickname)
+	s.mu.Unlock()
+
+	// Whatever arrived in the meantime waits in the mailbox instead,
+	// which writes to disk, so not under the server lock
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	moved := 0
+	for _, ev := range held.Queue {
+		if err := s.mailbox.Enqueue(nickname, ev.ID, ev.From, ev.Body); err != nil {
+			s.logger.Printf("Lost a message from %s to %s: %v", ev.From, nickname, err)
+			continue
+		}
+		moved++
+	}
+	return moved, true
+}
+
+// Resume hands a held session to a new connection presenting its token,
+// returning the session's nickname
+func (s *Server) Resume(token string, client *Client) (string, bool, string) {
+	s.mu.Lock()
+	var held *HeldSession
+	for _, h := range s.held {
+		if subtle.ConstantTimeCompare([]byte(h.token), []byte(token)) == 1 {
+			held = h
+			break
+		}
+	}
+
+	// The old connection may be dead without the server having noticed
+	// yet, the token proves the new one belongs to the same user. It is
+	// closed once the lock is released, its handler finds the nickname gone.
+	var stale *Client
+	if held == nil && s.config.ResumeGrace > 0 {
+		for nick, c := range s.clients {
+			if c.resumeToken != "" && subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) == 1 {
+				c.noResume.Store(true)
+				stale = c
+				held = s.hold(nick, c)
+				break
+			}
+		}
+	}
+	fail := func(msg string) (string, bool, string) {
+		s.mu.Unlock()
+		if stale != nil {
+			stale.close()
+		}
+		return "", false, msg
+	}
+	if held == nil || time.Now().After(held.Expires) {
+		return fail("Resume failed: unknown or expired token")
+	}
+
+	// A linked server doesn't know the nickname is held here, one of its
+	// users may have taken it meanwhile. The session stays held in case
+	// they leave before it expires.
+	nickname := held.Nickname
+	if user, remote := s.remote[nickname]; remote {
+		return fail(fmt.Sprintf("Resume failed: %s was taken on server %s", nickname, user.Server))
+	}
+	if ban, banned := s.bans.Check(nickname); banned {
+		return fail("Resume failed: " + ban.describe())
+	}
+
+	delete(s.held, nickname)
+	s.clients[nickname] = client
+	client.nickname = nickname
+	client.account = held.Account
+	client.ignores = held.ignores
+	client.highlights = held.highlights
+	client.signon = time.Now()
+	client.since = held.since
+	client.resumeToken = held.token
+	s.broadcastLinks(s.userFrame(nickname, client), nil)
+	s.deliver(nickname, client, Event{Type: "resume", Body: client.resumeToken, Time: time.Now()})
+	s.notifyBots("join", nickname, nil)
+	s.mu.Unlock()
+	if stale != nil {
+		stale.close()
+	}
+	s.logger.Printf("User %s resumed their session from %s", nickname, client.conn.RemoteAddr())
+
+	for _, room := range held.Rooms {
+		s.JoinRoom(nickname, room)
+	}
+
+	// Messages held during the grace period come first, then any in the mailbox
+	delivered := 0
+	for _, ev := range held.Queue {
+		ev.Offline = true
+		if sent, _ := client.offer(ev, 5*time.Second); sent {
+			delivered++
+		}
+	}
+	delivered += s.deliverOffline(nickname, client)
+	return nickname, true, fmt.Sprintf("Resumed session as %s, %d queued message(s) delivered", nickname, delivered)
+}
+
+// ChangeNickname changes a client's nickname
+func (s *Server) ChangeNickname(oldNick, newNick string, client *Client) (bool, string) {
+	// Validate nickname format: ensure it starts with a letter and contains only letters, numbers, and underscores
+	valid, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]{0,11}$`, newNick)
+	if !valid {
+		return false, "Invalid nickname format"
+	}
+
+	if ban, banned := s.bans.Check(newNick); banned {
+		return false, ban.describe()
+	}
+
+	if reason := s.reserved(newNick, client); reason != "" {
+		return false, reason
+	}
+
+	s.mu.Lock()
+
+	// Check if the new nickname is already in use
+	if s.nickInUse(newNick) {
+		s.mu.Unlock()
+		return false, fmt.Sprintf("Nickname %s already in use", newNick)
+	}
+
+	// Check if the old nickname exists and matches the client
+	if oldClient, exists := s.clients[oldNick]; exists && oldClient == client {
+		delete(s.clients, oldNick)
+		s.clients[newNick] = client
+		client.nickname = newNick
+		client.signon = time.Now()
+		client.since = client.signon
+		s.broadcastLinks(linkFrame{Type: "quit", Nick: oldNick, Server: s.config.ServerName}, nil)
+		s.broadcastLinks(s.userFrame(newNick, client), nil)
+		s.cancelTransfers(oldNick, fmt.Sprintf("%s changed nickname", oldNick))
+		s.logger.Printf("User %s changed nickname to %s", oldNick, newNick)
+
+		// A mute follows the user, a new nickname is no way out of it
+		if until, muted := s.mutes[oldNick]; muted {
+			delete(s.mutes, oldNick)
+			s.mutes[newNick] = until
+		}
+
+		// Carry room memberships over to the new nickname
+		for _, room := range s.rooms {
+			if _, member := room.members[oldNick]; member {
+				delete(room.members, oldNick)
+				room.members[newNick] = client
+				s.notifyRoom(room, newNick, fmt.Sprintf("*** %s is now known as %s", oldNick, newNick))
+			}
+		}
+		s.mu.Unlock()
+
+		if err := s.mailbox.MarkKnown(newNick); err != nil {
+			s.logger.Printf("Failed to save the mailbox: %v", err)
+		}
+		if n := s.deliverOffline(newNick, client); n > 0 {
+			return true, fmt.Sprintf("Nickname changed to %s successfully, %d offline message(s) delivered", newNick, n)
+		}
+		return true, fmt.Sprintf("Nickname changed to %s successfully", newNick)
+	}
+
+	s.mu.Unlock()
+	return false, "Cannot change nickname: current nickname not found"
+}
+
+// nicknameOf returns a client's nickname, empty if it has none
+func (s *Server) nicknameOf(client *Client) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return client.nickname
+}
+
+// ListUsers returns a list of all connected users
+func (s *Server) ListUsers() []Presence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]Presence, 0, len(s.clients)+len(s.remote))
+	for nick, client := range s.clients {
+		users = append(users, presence(nick, client))
+	}
+	for _, user := range s.remote {
+		users = append(users, user.presence())
+	}
+
+	// Sort the list of users alphabetically
+	sort.Slice(users, func(i, j int) bool { return users[i].Nickname < users[j].Nickname })
+	return users
+}
+
+// SetAway marks a user as away with a message, or as back when the message is empty
+func (s *Server) SetAway(nickname, message string) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, exists := s.clients[nickname]
+	if !exists {
+		return false, fmt.Sprintf("No such user: %s", nickname)
+	}
+
+	if message == "" {
+		if client.away == "" {
+			return false, "You are not marked as away"
+		}
+		client.away = ""
+		client.awaySince = time.Time{}
+		return true, "You are no longer marked as away"
+	}
+
+	client.away = message
+	client.awaySince = time.Now()
+	return true, fmt.Sprintf("You are now marked as away: %s", message)
+}
+
+// Whois returns the presence of a connected user
+func (s *Server) Whois(nickname string) (Presence, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, exists := s.remote[nickname]; exists {
+		return user.presence(), true
+	}
+	client, exists := s.clients[nickname]
+	if !exists {
+		return Presence{}, false
+	}
+	return presence(nickname, client), true
+}
+
+// deliver queues a message on a client's outCh without ever waiting, so
+// it may be called with s.mu held. Under the block policy a full channel
+// drops the message here, only senders outside the lock wait, see queue.
+func (s *Server) deliver(nickname string, client *Client, ev Event) bool {
+	return s.queue(nickname, client, ev, false)
+}
+
+// queue puts a message on a client's outCh, applying the slow-consumer
+// policy when the channel is full. With wait set the block policy waits
+// for room, which the caller must not do while holding s.mu.
+func (s *Server) queue(nickname string, client *Client, ev Event, wait bool) bool {
+	// Nothing new is queued once shutdown is flushing the clients
+	if s.closing.Load() {
+		return false
+	}
+
+	// Once messages spill to disk, later ones follow them to keep the order
+	if client.spill != nil && client.spill.Len() > 0 {
+		return s.spillMessage(nickname, client, ev)
+	}
+
+	// A client that has gone away isn't a slow one
+	if sent, open := client.offer(ev, 0); sent || !open {
+		return sent
+	}
+
+	overflows := client.overflows.Add(1)
+	switch s.config.SlowPolicy {
+	case PolicyBlock:
+		if wait {
+			if sent, _ := client.offer(ev, s.config.BlockTimeout); sent {
+				return true
+			}
+		}
+	case PolicySpill:
+		// Bots have no overflow queue, they drop like everyone else without one
+		if client.spill != nil {
+			return s.spillMessage(nickname, client, ev)
+		}
+	case PolicyDisconnect:
+		if overflows >= s.config.MaxOverflows {
+			s.logger.Printf("Disconnecting slow client %s after %d overflows", nickname, overflows)
+			// Like any forced disconnect the nickname isn't held for a
+			// resume, and the client isn't waited on to drain its queue
+			s.disconnect(client, fmt.Sprintf("*** Disconnected: too slow, %d messages overflowed", overflows))
+			client.close()
+		}
+	}
+
+	// If the client's outCh is full, the message is dropped
+	client.dropped.Add(1)
+	s.metrics.dropped.Add(1)
+	s.logger.Printf("Failed to send message to %s: channel full", nickname)
+	return false
+}
+
+// spillMessage queues a message in a client's overflow queue on disk
+func (s *Server) spillMessage(nickname string, client *Client, ev Event) bool {
+	if !client.spill.Push(ev) {
+		client.dropped.Add(1)
+		s.metrics.dropped.Add(1)
+		s.logger.Printf("Failed to send message to %s: overflow queue full", nickname)
+		return false
+	}
+	client.spilled.Add(1)
+	return true
+}
+
+// AllowMessage charges a message to the budgets of both the connection and
+// its nickname, reporting how long to wait when either one is used up
+func (s *Server) AllowMessage(client *Client, nickname string, broadcast bool) (bool, time.Duration) {
+	s.limitsMu.Lock()
+	// Now and then the refilled budgets are dropped, a new one would be
+	// the same, so the map doesn't keep every nickname ever used
+	if time.Since(s.limitsSwept) >= limitsSweep {
+		for nick, limits := range s.nickLimits {
+			if limits.full() {
+				delete(s.nickLimits, nick)
+			}
+		}
+		s.limitsSwept = time.Now()
+	}
+	limits, exists := s.nickLimits[nickname]
+	if !exists {
+		limits = newRateLimits(s.config)
+		s.nickLimits[nickname] = limits
+	}
+	s.limitsMu.Unlock()
+
+	connBucket := client.limits.bucket(broadcast)
+	if ok, wait := connBucket.Take(); !ok {
+		return false, wait
+	}
+	if ok, wait := limits.bucket(broadcast).Take(); !ok {
+		connBucket.Refund()
+		return false, wait
+	}
+	return true, 0
+}
+
+// disconnect tells a client why it is being dropped and closes its queue.
+// The client's writer flushes the notice and closes the connection, which
+// makes its handler unregister it, so the caller never waits on a slow
+// connection and nothing else writes to it.
+func (s *Server) disconnect(client *Client, notice string) {
+	client.noResume.Store(true)
+	if client.bot != nil {
+		client.close()
+		return
+	}
+	// As at shutdown, a client too slow to take the notice misses it
+	client.offer(Event{Type: "notice", Body: notice, Time: time.Now()}, 0)
+	client.closeOut()
+}
+
+// addConn tracks a new connection, refusing it once shutdown has started
+func (s *Server) addConn(client *Client) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Check if the nickname is already in use
-	if _, exists := s.clients[nickname]; exists {
-		return false, fmt.Sprintf("Nickname %s already in use", nickname)
+	if s.closing.Load() {
+		return false
 	}
-
-	s.clients[nickname] = client
-	s.logger.Printf("User registered with nickname: %s", nickname)
-	return true, fmt.Sprintf("Nickname %s registered successfully", nickname)
+	s.conns[client] = struct{}{}
+	s.handlers.Add(1)
+	return true
 }
 
-// UnregisterClient removes a client from the server
-func (s *Server) UnregisterClient(nickname string) {
+// release stops tracking a connection, then closes its queue. In that
+// order shutdown never finds a connection that can't take its notice.
+func (s *Server) release(client *Client) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	delete(s.conns, client)
+	s.mu.Unlock()
 
-	if _, exists := s.clients[nickname]; exists {
-		delete(s.clients, nickname)
-		s.logger.Printf("User %s left the chat", nickname)
-	}
+	client.closeOut()
 }
 
-// ChangeNickname changes a client's nickname
-func (s *Server) ChangeNickname(oldNick, newNick string, client *Client) (bool, string) {
-	// Validate nickname format: ensure it starts with a letter and contains only letters, numbers, and underscores
-	valid, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]{0,11}$`, newNick)
-	if !valid {
-		return false, "Invalid nickname format"
-	}
+// removeConn forgets a connection once its handler has finished
+func (s *Server) removeConn(client *Client) {
+	s.release(client)
+	s.handlers.Done()
+}
+
+// Shutdown sends a notice to every connection, gives each one until the
+// deadline to flush its queued messages, then closes them all. The caller
+// is expected to have stopped accepting new connections.
+func (s *Server) Shutdown(notice string, timeout time.Duration) ShutdownSummary {
+	start := time.Now()
+	var summary ShutdownSummary
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.closing.Store(true)
+	clients := make([]*Client, 0, len(s.conns))
+	for client := range s.conns {
+		clients = append(clients, client)
+		summary.Connections++
+		if client.nickname != "" {
+			summary.Users++
+		}
+		// The notice is the last thing queued, deliver turns everything
+		// else away from now on. A client too slow to take it misses it.
+		client.offer(Event{Type: "notice", Body: notice, Time: time.Now()}, 0)
+	}
+	for _, bot := range s.bots {
+		bot.stop()
+	}
+	s.mu.Unlock()
 
-	// Check if the new nickname is already in use
-	if _, exists := s.clients[newNick]; exists {
-		return false, fmt.Sprintf("Nickname %s already in use", newNick)
+	// Ask every writer to flush what it has queued and stop
+	queued := 0
+	for _, client := range clients {
+		queued += pendingMessages(client)
+		close(client.quit)
 	}
 
-	// Check if the old nickname exists and matches the client
-	if oldClient, exists := s.clients[oldNick]; exists && oldClient == client {
-		delete(s.clients, oldNick)
-		s.clients[newNick] = client
-		s.logger.Printf("User %s changed nickname to %s", oldNick, newNick)
-		return true, fmt.Sprintf("Nickname changed to %s successfully", newNick)
+	deadline := time.After(timeout)
+	for _, client := range clients {
+		select {
+		case <-client.done:
+		case <-deadline:
+		}
+		select {
+		case <-client.done:
+		default:
+			summary.TimedOut++
+			summary.Unsent += pendingMessages(client)
+		}
+		client.conn.Close()
 	}
+	summary.Flushed = queued - summary.Unsent
 
-	return false, "Cannot change nickname: current nickname not found"
+	// Closing the connections ends the handlers, which unregister their users
+	finished := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		s.logger.Printf("Some connection handlers did not finish")
+	}
+
+	// Linked servers see the users leave above, then the link itself goes
+	s.mu.RLock()
+	for _, link := range s.links {
+		link.conn.Close()
+	}
+	s.mu.RUnlock()
+
+	summary.Duration = time.Since(start)
+	return summary
 }
 
-// ListUsers returns a list of all connected users
-func (s *Server) ListUsers() []string {
+// pendingMessages counts the messages still waiting to be written to a client
+func pendingMessages(client *Client) int {
+	n := len(client.outCh)
+	if client.spill != nil {
+		n += client.spill.Len()
+	}
+	return n
+}
+
+// Stats returns the delivery counters of a connected user
+func (s *Server) Stats(nickname string) (ClientStats, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users := make([]string, 0, len(s.clients))
-	for nick := range s.clients {
-		users = append(users, nick)
+	client, exists := s.clients[nickname]
+	if !exists {
+		return ClientStats{}, false
 	}
-	
-	// Sort the list of users alphabetically
-	sort.Strings(users)
-	return users
+	return clientStats(client), true
+}
+
+// clientStats takes a snapshot of a client's delivery counters
+func clientStats(client *Client) ClientStats {
+	stats := ClientStats{
+		Queued:    len(client.outCh),
+		Capacity:  cap(client.outCh),
+		Dropped:   client.dropped.Load(),
+		Spilled:   client.spilled.Load(),
+		Overflows: client.overflows.Load(),
+	}
+	if client.spill != nil {
+		stats.OnDisk = client.spill.Len()
+	}
+	return stats
+}
+
+// outgoing is a message for a local user that SendMessage hands over once
+// it has released s.mu, so a slow reader under the block policy only holds
+// up the sender
+type outgoing struct {
+	nickname string
+	client   *Client
+	ev       Event
 }
 
 // SendMessage sends a message from a sender to one or more recipients
-func (s *Server) SendMessage(sender, recipients, message string) ([]string, []string) {
+func (s *Server) SendMessage(sender, recipients, message string) SendResult {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 
 	var recipientList []string
 	if recipients == "*" {
-		// Send to all users except the sender
+		// Send to all users except the sender, on every server
 		for nick := range s.clients {
 			if nick != sender {
 				recipientList = append(recipientList, nick)
 			}
 		}
+		for nick := range s.remote {
+			recipientList = append(recipientList, nick)
+		}
 	} else {
 		// Split the recipients string by commas
 		recipientList = strings.Split(recipients, ",")
@@ -131,27 +1463,190 @@ func (s *Server) SendMessage(sender, recipients, message string) ([]string, []st
 		}
 	}
 
-	success := []string{}
-	failed := []string{}
+	var result SendResult
+	var delivered []string // Direct recipients, recorded in the history as one entry
+	var tracked []string   // Direct recipients here that may send a read receipt
+	var public []string    // Rooms the message went to
+	var offline []string   // Recipients whose mailbox gets the message once the lock is released
+
+	// Muted users can't send anything
+	if until, muted := s.mutes[sender]; muted && (until.IsZero() || time.Now().Before(until)) {
+		result.Failed = recipientList
+		result.Rejected = "You are muted"
+		if !until.IsZero() {
+			result.Rejected += fmt.Sprintf(" until %s", until.Format(time.DateTime))
+		}
+		s.mu.RUnlock()
+		return result
+	}
+
+	// Operator filters may refuse the message, censor it or report it
+	message, rejected, flagged := s.filters.Apply(message)
+	if rejected {
+		result.Failed = recipientList
+		result.Rejected = "Message blocked by a filter"
+		s.mu.RUnlock()
+		return result
+	}
+	result.ID = s.newMessageID()
+
+	// Mentions and keywords are looked for once, then matched per recipient
+	mentioned, words := mentionsOf(message), wordsOf(message)
+	tag := func(nickname string, keywords []string, ev Event) Event {
+		ev.Tags = highlights(nickname, keywords, mentioned, words)
+		return ev
+	}
+
+	// Local users are handed their messages once the lock is released
+	var direct, notices []outgoing
+	rooms := make(map[string][]outgoing)
 
 	// Send the message to each recipient
 	for _, r := range recipientList {
-		if client, exists := s.clients[r]; exists {
-			formattedMsg := fmt.Sprintf("%s: %s\r\n", sender, message)
-			select {
-			case client.outCh <- formattedMsg:
-				success = append(success, r)
-			default:
-				// If the client's outCh is full, the message is dropped
-				s.logger.Printf("Failed to send message to %s: channel full", r)
-				failed = append(failed, r)
+		if strings.HasPrefix(r, "#") {
+			// Room recipient: deliver to every member except the sender
+			room, exists := s.rooms[r]
+			if !exists {
+				result.Failed = append(result.Failed, r)
+				continue
+			}
+			if _, member := room.members[sender]; !member {
+				result.Failed = append(result.Failed, r)
+				continue
+			}
+			ev := Event{Type: "message", ID: result.ID, From: sender, To: r, Body: message, Time: time.Now()}
+			for nick, client := range room.members {
+				if nick == sender || client.ignores[sender] {
+					continue
+				}
+				rooms[r] = append(rooms[r], outgoing{nick, client, tag(nick, client.highlights, ev)})
+			}
+			result.Success = append(result.Success, r)
+			public = append(public, r)
+		} else if client, exists := s.clients[r]; exists {
+			if client.ignores[sender] {
+				s.ignoredBy(&result, r, &result.Success)
+				continue
+			}
+			ev := Event{Type: "message", ID: result.ID, From: sender, To: r, Body: message, Time: time.Now()}
+			if recipients == "*" {
+				ev.To = "*"
+			}
+			direct = append(direct, outgoing{r, client, tag(r, client.highlights, ev)})
+
+			// Let the sender of a direct message know the recipient may not see it soon
+			if client.away != "" && recipients != "*" {
+				if senderClient, online := s.clients[sender]; online {
+					away := Event{Type: "notice", From: r, Body: fmt.Sprintf("*** %s is away: %s", r, client.away), Time: time.Now()}
+					notices = append(notices, outgoing{sender, senderClient, away})
+				}
+			}
+		} else if held, exists := s.held[r]; exists {
+			if held.ignores[sender] {
+				s.ignoredBy(&result, r, &result.Queued)
+				continue
 			}
+			// The user's connection dropped moments ago, keep the message for the resume
+			held.mu.Lock()
+			if len(held.Queue) < s.config.MailboxCap {
+				ev := Event{Type: "message", ID: result.ID, From: sender, To: r, Body: message, Time: time.Now()}
+				held.Queue = append(held.Queue, tag(r, held.highlights, ev))
+				result.Queued = append(result.Queued, r)
+				tracked = append(tracked, r)
+			} else {
+				result.Failed = append(result.Failed, r)
+			}
+			held.mu.Unlock()
+		} else if user, exists := s.remote[r]; exists {
+			// The user is on another server, pass the message along the link towards it.
+			// Broadcasts are passed on once for every server below.
+			if recipients != "*" {
+				user.link.send(linkFrame{Type: "msg", From: sender, To: r, Body: message, Time: time.Now()})
+			}
+			result.Success = append(result.Success, r)
+			delivered = append(delivered, r)
+		} else if slices.Contains(s.accounts.Ignores(r), sender) {
+			// Offline, but the user's ignore list was saved with their account
+			s.ignoredBy(&result, r, &result.Queued)
+		} else {
+			offline = append(offline, r)
+		}
+	}
+
+	if recipients == "*" {
+		s.broadcastLinks(linkFrame{Type: "msg", From: sender, To: "*", Body: message, Time: time.Now()}, nil)
+	}
+	if len(flagged) > 0 {
+		s.flagMessage(sender, recipients, message, flagged)
+	}
+
+	// Offline users mentioned in a room or to everyone get a digest when they return
+	var mention Mention
+	var digests []string
+	if recipients == "*" || len(public) > 0 {
+		mention = Mention{From: sender, To: "*", Body: message, Time: time.Now()}
+		if recipients != "*" {
+			mention.To = strings.Join(public, ",")
+		}
+		digests = s.mentionedOffline(sender, mentioned)
+	}
+	s.mu.RUnlock()
+
+	// Known nicknames that are offline have the message held until they
+	// register again. The mailbox writes to disk, so not under the lock.
+	for _, r := range offline {
+		if err := s.mailbox.Enqueue(r, result.ID, sender, message); err != nil {
+			if !errors.Is(err, ErrUnknownNickname) && !errors.Is(err, ErrMailboxFull) {
+				s.logger.Printf("Failed to queue a message for %s: %v", r, err)
+			}
+			result.Failed = append(result.Failed, r)
+			continue
+		}
+		result.Queued = append(result.Queued, r)
+		tracked = append(tracked, r)
+		s.catchUp(r)
+	}
+	for _, nick := range digests {
+		if err := s.mailbox.AddMention(nick, mention); err != nil && !errors.Is(err, ErrUnknownNickname) && !errors.Is(err, ErrMailboxFull) {
+			s.logger.Printf("Failed to keep a mention of %s: %v", nick, err)
+		}
+	}
+
+	// Waiting for a slow reader now holds up no one but the sender
+	for _, o := range direct {
+		if s.queue(o.nickname, o.client, o.ev, true) {
+			result.Success = append(result.Success, o.nickname)
+			delivered = append(delivered, o.nickname)
+			tracked = append(tracked, o.nickname)
 		} else {
-			failed = append(failed, r)
+			result.Failed = append(result.Failed, o.nickname)
+		}
+	}
+	for _, o := range notices {
+		s.queue(o.nickname, o.client, o.ev, false)
+	}
+	for _, r := range public {
+		var members []string
+		for _, o := range rooms[r] {
+			if s.queue(o.nickname, o.client, o.ev, true) {
+				members = append(members, o.nickname)
+			}
 		}
+		s.logHistory(sender, r, members, message)
 	}
 
-	return success, failed
+	if len(delivered) > 0 {
+		to := recipients
+		if to != "*" {
+			to = strings.Join(delivered, ",")
+		}
+		s.logHistory(sender, to, delivered, message)
+	}
+	if recipients != "*" && len(tracked) > 0 {
+		s.trackMessage(result.ID, sender, tracked)
+	}
+	s.metrics.routed.Add(int64(len(result.Success) + len(result.Queued)))
+	return result
 }
 
 // handleConnection handles a new client connection
@@ -163,116 +1658,251 @@ func handleConnection(server *Server, conn net.Conn) {
 
 	server.logger.Printf("New connection from %s", conn.RemoteAddr())
 
+	// Turn away banned addresses before anything else
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if ban, banned := server.bans.Check(host); banned {
+		server.logger.Printf("Refused connection from banned address %s", host)
+		conn.Write([]byte("You are banned: " + ban.describe() + "\r\n"))
+		return
+	}
+
 	// Initialize a new client
 	client := &Client{
-		conn:  conn,
-		outCh: make(chan string, 10), // Use a buffered channel of capacity 10
+		conn:   conn,
+		outCh:  make(chan Event, 10), // Use a buffered channel of capacity 10
+		fileCh: make(chan Event, 4),  // A few chunks, transfers wait for the recipient
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+
+		limits:       newRateLimits(server.config),
+		writeTimeout: server.config.WriteTimeout,
+
+		connectedAt: time.Now(),
+	}
+	client.lastActive.Store(client.connectedAt.UnixNano())
+	if !server.addConn(client) {
+		// The server is shutting down
+		return
+	}
+	defer server.removeConn(client)
+	server.metrics.connections.Add(1)
+	defer func() {
+		server.metrics.observeConnection(time.Since(client.connectedAt))
+	}()
+
+	if server.config.SlowPolicy == PolicySpill {
+		path := filepath.Join(server.config.DataDir, "spill", fmt.Sprintf("%d.queue", server.nextConnID.Add(1)))
+		spill, err := NewSpillQueue(path, server.config.SpillLimit)
+		if err != nil {
+			server.logger.Printf("Failed to create overflow queue for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer spill.Close()
+		client.spill = spill
 	}
 
 	// Start a goroutine to send messages to the client
 	go func() {
-		for msg := range client.outCh {
-			_, err := conn.Write([]byte(msg))
-			if err != nil {
-				server.logger.Printf("Error writing to client: %v", err)
+		defer close(client.done)
+
+		// write sends an event, acknowledging a direct message to its sender
+		// once it has reached the connection
+		write := func(ev Event) error {
+			if err := client.writeEvent(ev); err != nil {
+				return err
+			}
+			server.acknowledge(ev)
+			return nil
+		}
+
+		// Spilled messages are waited on through a channel that is nil without a spill queue
+		var spillReady chan struct{}
+		if client.spill != nil {
+			spillReady = client.spill.ready
+		}
+
+		// Keepalive PINGs are likewise disabled by a nil channel
+		var pingTick <-chan time.Time
+		if server.config.PingInterval > 0 {
+			ticker := time.NewTicker(server.config.PingInterval)
+			defer ticker.Stop()
+			pingTick = ticker.C
+		}
+
+		// flush writes everything queued, outCh first since it was
+		// filled before anything spilled to disk
+		flush := func() error {
+			// Only this goroutine receives from outCh, so a queued message never blocks
+			for len(client.outCh) > 0 {
+				if err := write(<-client.outCh); err != nil {
+					return err
+				}
+			}
+			if client.spill != nil {
+				for ev, ok := client.spill.Pop(); ok; ev, ok = client.spill.Pop() {
+					if err := write(ev); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		for {
+			select {
+			case ev, ok := <-client.outCh:
+				if !ok {
+					// The handler is done, or the client was dropped by
+					// disconnect after its notice, which was written above
+					conn.Close()
+					return
+				}
+				if err := write(ev); err != nil {
+					server.logger.Printf("Error writing to client: %v", err)
+					return
+				}
+			case <-spillReady:
+				if err := flush(); err != nil {
+					server.logger.Printf("Error writing to client: %v", err)
+					return
+				}
+			case ev := <-client.fileCh:
+				// Chat messages go first, a transfer only uses an idle connection
+				for len(client.outCh) > 0 {
+					if err := write(<-client.outCh); err != nil {
+						server.logger.Printf("Error writing to client: %v", err)
+						return
+					}
+				}
+				if err := write(ev); err != nil {
+					server.logger.Printf("Error writing to client: %v", err)
+					return
+				}
+			case <-pingTick:
+				if missed := client.missedPings.Add(1) - 1; missed >= server.config.MaxMissedPings {
+					// Closing the connection ends the read loop, which unregisters the client
+					server.logger.Printf("Disconnecting %s (%s): missed %d PINGs", conn.RemoteAddr(), server.nicknameOf(client), missed)
+					conn.Close()
+					return
+				}
+				token := strconv.FormatInt(client.pingSeq.Add(1), 10)
+				if err := write(Event{Type: "ping", Body: token, Time: time.Now()}); err != nil {
+					server.logger.Printf("Error writing to client: %v", err)
+					return
+				}
+			case <-client.quit:
+				// The server is shutting down, send what is left and stop
+				if err := flush(); err != nil {
+					server.logger.Printf("Error writing to client: %v", err)
+				}
 				return
 			}
 		}
 	}()
 
+	var nickname string
+
+	// TLS connections may present a client certificate naming the user
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			server.logger.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			// The certificate was verified against the client CA, so it
+			// identifies the user as the account named by its CN
+			cn := certs[0].Subject.CommonName
+			server.setAccount(client, cn)
+			server.restoreIgnores(client)
+			server.logger.Printf("Client %s authenticated as %s by certificate", conn.RemoteAddr(), cn)
+			success, msg := server.RegisterClient(cn, client)
+			if success {
+				nickname = cn
+			}
+			conn.Write([]byte(fmt.Sprintf("Authenticated as %s by client certificate. %s\r\n", cn, msg)))
+		}
+	}
+
 	// Send a welcome message to the client
 	conn.Write([]byte("Welcome to the Go Chat Server!\r\n"))
-	conn.Write([]byte("Please set a nickname with /NICK <nickname> or /N <nickname>\r\n"))
+	if nickname == "" {
+		conn.Write([]byte("Please set a nickname with /NICK <nickname> or /N <nickname>\r\n"))
+	}
 
 	scanner := bufio.NewScanner(conn)
-	var nickname string
 
-	for scanner.Scan() {
+	for {
+		// A client that sends nothing, not even a PONG, is dropped once the read timeout passes
+		if server.config.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(server.config.ReadTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		// Any line shows the client is alive, clients that never answer PINGs included
+		client.missedPings.Store(0)
 		command := strings.TrimSpace(scanner.Text())
-		var response string
-		
+		var id string
 
-		// Handle commands
-		if strings.HasPrefix(command, "/NICK ") || strings.HasPrefix(command, "/N ") {
-			// NICK Command
-			parts := strings.SplitN(command, " ", 2)
-			if len(parts) < 2 {
-				response = "Invalid NICK format. Use /NICK <nickname>"
-			} else {
-				newNick := strings.Split(parts[1], " ")[0] // Extract the nickname
-				if nickname == "" {
-					// register new nickname
-					success, msg := server.RegisterClient(newNick, client)
-					response = msg
-					if success {
-							nickname = newNick
-							client.nickname = nickname
-					}
-				} else {
-					// change nickname
-					success, msg := server.ChangeNickname(nickname, newNick, client); 
-					response = msg
-					if success {
-						nickname = newNick
-						client.nickname = nickname
-					}
-				}
-			}
-		} else if command == "/NICK" || command == "/N" {
-			// Invalid NICK command
-			response = "Invalid NICK format. Use /NICK <nickname>"
-		} else if command == "/LIST" || command == "/L" || strings.HasPrefix(command, "/LIST ") || strings.HasPrefix(command, "/L ") {
-			// LIST Command
-			users := server.ListUsers()
-			if len(users) == 0 {
-				response = "No users currently connected."
-			} else {
-				response = "Users: " + strings.Join(users, ", ")
-			}
-		} else if strings.HasPrefix(command, "/MSG ") || strings.HasPrefix(command, "/M ") {
-			// MSG Command
-			if nickname == "" {
-				response = "You must set a nickname before sending messages. Use /NICK <nickname>"
-			} else {
-				parts := strings.SplitN(command, " ", 3)
-				if len(parts) < 3 {
-					response = "Invalid MSG format. Use /MSG <recipients> <message>"
-				} else {
-					recipients := parts[1]
-					message := parts[2]
-					success, failed := server.SendMessage(nickname, recipients, message)
-
-					if len(failed) == 0 {
-						recipientDisplay := recipients
-						if recipients == "*" {
-							recipientDisplay = "all users"
-						}
-						response = fmt.Sprintf("Message sent to %s", recipientDisplay)
-					} else if len(success) == 0 {
-						response = fmt.Sprintf("No recipients found: %s", strings.Join(failed, ", "))
-					} else {
-						response = fmt.Sprintf("Message sent to %s, recipients not found: %s",
-							strings.Join(success, ", "), strings.Join(failed, ", "))
-					}
-				}
+		// Keepalive answers need no reply, in either protocol
+		if token, ok := strings.CutPrefix(command, "PONG "); ok {
+			client.pong(token)
+			continue
+		}
+
+		// In the JSON protocol every line is a request frame
+		if client.jsonMode.Load() {
+			var req request
+			if err := json.Unmarshal([]byte(command), &req); err != nil || req.Command == "" {
+				client.writeReply("", "", errReply(StatusBadRequest, `Invalid frame. Send {"id": "...", "command": "...", "args": [...]}`))
+				continue
 			}
-		} else {
-			response = "Unknown command. Available commands: /NICK <nickname>, /LIST, /MSG <recipients> <message>"
+			id = req.ID
+			command = strings.TrimSpace("/" + strings.TrimPrefix(strings.ToUpper(req.Command), "/") + " " + strings.Join(req.Args, " "))
+		}
+
+		if token, ok := strings.CutPrefix(command, "/PONG "); ok {
+			client.pong(token)
+			continue
+		}
+
+		// Anything but a keepalive counts as activity for /WHOIS
+		client.lastActive.Store(time.Now().UnixNano())
+
+		// Handle commands
+		ctx := &CommandContext{Server: server, Client: client, Nickname: nickname}
+		reply := server.commands.Dispatch(ctx, command)
+		nickname = ctx.Nickname
+		if ctx.silent {
+			continue
 		}
 
-		// Send the response to the client 
-		conn.Write([]byte(response + "\r\n"))
+		// Send the reply to the client
+		client.writeReply(id, commandName(command), reply)
+		if ctx.disconnect {
+			// Clients dropped on purpose don't get their nickname held
+			client.noResume.Store(true)
+			break
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		server.logger.Printf("Error reading from client: %v", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			server.logger.Printf("Disconnecting %s (%s): idle for %v", conn.RemoteAddr(), nickname, server.config.ReadTimeout)
+		} else {
+			server.logger.Printf("Error reading from client: %v", err)
+		}
 	}
 
-	// Unregister the client when the connection is closed
+	// Unregister the client when the connection is closed, or hold its
+	// nickname for a while if the connection merely dropped
 	if nickname != "" {
-		server.UnregisterClient(nickname)
+		server.Detach(nickname, client)
 	}
-	close(client.outCh)
+	server.release(client)
 }
 
 func main() {
@@ -281,8 +1911,86 @@ func main() {
 	port := flag.Int("port", 6666, "Port to listen on")
 	// default log file is stdout
 	logFile := flag.String("log", "", "Log file (default: stdout)")
+	// server state such as offline messages is kept in ./data
+	dataDir := flag.String("data", "data", "Directory for persisted server state")
+	mailboxCap := flag.Int("mailbox-cap", 100, "Maximum offline messages kept per user")
+	mailboxTTL := flag.Duration("mailbox-ttl", 7*24*time.Hour, "How long offline messages are kept")
+	reserveNicks := flag.Bool("reserve-nicks", true, "Reserve registered nicknames for their owners")
+	// TLS is enabled by providing a certificate and key
+	plain := flag.Bool("plain", true, "Accept plaintext connections on -port")
+	tlsPort := flag.Int("tls-port", 6697, "Port to listen on for TLS connections")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file for verifying client certificates, enables mutual TLS")
+	// each connection and nickname may send 5 direct messages and 1 broadcast a second
+	dmRate := flag.Float64("dm-rate", 5, "Direct messages per second allowed per connection and nickname (0 disables)")
+	dmBurst := flag.Int("dm-burst", 10, "Direct messages allowed in a burst")
+	broadcastRate := flag.Float64("broadcast-rate", 1, "Broadcasts and room messages per second allowed (0 disables)")
+	broadcastBurst := flag.Int("broadcast-burst", 3, "Broadcasts and room messages allowed in a burst")
+	maxViolations := flag.Int("max-violations", 10, "Rate limit violations in a minute before a client is disconnected")
+	// operators are the accounts listed in this file
+	opsFile := flag.String("ops-file", "", "File listing operator accounts, one per line")
+	// clients are pinged every 30 seconds and dropped after 3 missed PINGs
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "How often clients are sent a keepalive PING (0 disables)")
+	maxMissedPings := flag.Int("max-missed-pings", 3, "Unanswered PINGs before a client is disconnected")
+	readTimeout := flag.Duration("read-timeout", 5*time.Minute, "How long a client may stay silent before it is disconnected (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "How long a write to a client may block (0 disables)")
+	// servers link into one network by dialing each other's link port
+	serverName := flag.String("server-name", "", "Name of this server in the network (default: hostname:port)")
+	linkPort := flag.Int("link-port", 0, "Port to accept links from other servers on (0 disables)")
+	links := flag.String("links", "", "Comma-separated addresses of servers to link with, e.g. host:7000")
+	linkSecret := flag.String("link-secret", "", "Password linked servers must share")
+	linkRetry := flag.Duration("link-retry", 5*time.Second, "How long to wait before redialing a lost link")
+	// files up to 10 MiB may be sent between users
+	maxFileSize := flag.Int64("max-file-size", 10<<20, "Largest file users may send each other, in bytes")
+	// a dropped client may reconnect and resume its session within a minute
+	resumeGrace := flag.Duration("resume-grace", time.Minute, "How long a dropped user's nickname and messages are held for a resume (0 disables)")
+	// bots such as an echo bot run inside the server when a bots file is given
+	botsFile := flag.String("bots-file", "", "JSON file listing the server-side bots to start")
+	// on SIGINT or SIGTERM clients get a notice and time to receive queued messages
+	shutdownMessage := flag.String("shutdown-message", "*** Server is shutting down", "Notice sent to every client at shutdown")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Second, "How long shutdown waits for clients to receive queued messages")
+	// the WebSocket gateway is off unless a port is given
+	wsPort := flag.Int("ws-port", 0, "Port for the WebSocket gateway at /ws (0 disables it)")
+	// so is the admin endpoint for metrics and the client listing. It has no
+	// authentication and /clients shows every user's address and account, so
+	// it only listens on loopback unless another address is given.
+	adminPort := flag.Int("admin", 0, "Port for the admin endpoint with /metrics and /clients (0 disables it)")
+	adminAddr := flag.String("admin-addr", "127.0.0.1", "Address the admin endpoint listens on. It is unauthenticated and lists client addresses and accounts, only widen it behind a firewall or proxy")
+	// IRC clients such as irssi or WeeChat may connect to an IRC port if one is given
+	ircPort := flag.Int("irc-port", 0, "Port for IRC clients (0 disables it)")
+	// the chat log is rotated once it reaches 1 MiB
+	historyMaxSize := flag.Int64("history-max-size", 1<<20, "Size in bytes at which the chat log is rotated")
+	historyKeep := flag.Int("history-keep", 5, "Number of rotated chat logs to keep")
+	// messages to a user from someone they ignore are silently dropped
+	ignoreMode := flag.String("ignore-mode", "drop", "What senders a user ignores are told: drop (message reported as sent) or fail")
+	// slow clients lose messages unless another policy is chosen
+	slowPolicy := flag.String("slow-policy", "drop", "What to do when a client falls behind: drop, block, spill or disconnect")
+	blockTimeout := flag.Duration("block-timeout", 500*time.Millisecond, "How long the block policy waits for a slow client")
+	spillLimit := flag.Int("spill-limit", 1000, "Maximum messages in a slow client's overflow queue on disk")
+	maxOverflows := flag.Int64("max-overflows", 20, "Overflows before the disconnect policy drops a slow client")
 	flag.Parse()
 
+	if (*linkPort != 0 || *links != "") && *linkSecret == "" {
+		log.Fatalf("Linking servers requires -link-secret")
+	}
+	if *serverName == "" {
+		hostname, _ := os.Hostname()
+		*serverName = fmt.Sprintf("%s:%d", hostname, *port)
+	}
+
+	switch IgnoreMode(*ignoreMode) {
+	case IgnoreDrop, IgnoreFail:
+	default:
+		log.Fatalf("Unknown ignore mode: %s", *ignoreMode)
+	}
+
+	switch SlowPolicy(*slowPolicy) {
+	case PolicyDrop, PolicyBlock, PolicySpill, PolicyDisconnect:
+	default:
+		log.Fatalf("Unknown slow client policy: %s", *slowPolicy)
+	}
+
 	// Create a logger
 	var logger *log.Logger
 	if *logFile != "" {
@@ -296,25 +2004,237 @@ func main() {
 		logger = log.New(os.Stdout, "", log.LstdFlags)
 	}
 
-	server := NewServer(logger)
+	server, err := NewServer(logger, Config{
+		DataDir:    *dataDir,
+		MailboxCap: *mailboxCap,
+		MailboxTTL: *mailboxTTL,
+
+		ReserveNicks: *reserveNicks,
+
+		HistoryMaxSize: *historyMaxSize,
+		HistoryKeep:    *historyKeep,
 
-	// Start the server
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+		IgnoreMode: IgnoreMode(*ignoreMode),
+
+		SlowPolicy:   SlowPolicy(*slowPolicy),
+		BlockTimeout: *blockTimeout,
+		SpillLimit:   *spillLimit,
+		MaxOverflows: *maxOverflows,
+
+		DMRate:         *dmRate,
+		DMBurst:        *dmBurst,
+		BroadcastRate:  *broadcastRate,
+		BroadcastBurst: *broadcastBurst,
+		MaxViolations:  *maxViolations,
+
+		OpsFile: *opsFile,
+
+		PingInterval:   *pingInterval,
+		MaxMissedPings: int32(*maxMissedPings),
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+
+		ServerName: *serverName,
+		LinkSecret: *linkSecret,
+		LinkRetry:  *linkRetry,
+
+		MaxFileSize: *maxFileSize,
+
+		ResumeGrace: *resumeGrace,
+	})
 	if err != nil {
-		logger.Fatalf("Failed to start server: %v", err)
+		logger.Fatalf("Failed to initialize server: %v", err)
+	}
+	if *botsFile != "" {
+		if err := server.LoadBots(*botsFile); err != nil {
+			logger.Fatalf("Failed to start bots: %v", err)
+		}
+	}
+
+	// Start the plaintext and TLS listeners side by side
+	var wg sync.WaitGroup
+	var listeners []net.Listener
+	if *plain {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+		if err != nil {
+			logger.Fatalf("Failed to start server: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("Chat server started on port %d", *port)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(server, listener)
+		}()
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			logger.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", *tlsPort), config)
+		if err != nil {
+			logger.Fatalf("Failed to start TLS server: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("Chat server started on TLS port %d", *tlsPort)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(server, listener)
+		}()
+	} else if !*plain {
+		logger.Fatalf("Nothing to listen on: -plain=false requires -tls-cert and -tls-key")
+	}
+
+	if *wsPort != 0 {
+		// WebSocket users join through an HTTP endpoint, e.g. ws://host:8080/ws
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(server, w, r)
+		})
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *wsPort))
+		if err != nil {
+			logger.Fatalf("Failed to start WebSocket gateway: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("WebSocket gateway started on port %d at /ws", *wsPort)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Printf("WebSocket gateway stopped: %v", err)
+			}
+		}()
+	}
+
+	if *ircPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *ircPort))
+		if err != nil {
+			logger.Fatalf("Failed to start IRC listener: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("IRC listener started on port %d", *ircPort)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveIRC(server, listener)
+		}()
 	}
-	defer listener.Close()
 
-	logger.Printf("Chat server started on port %d", *port)
+	if *adminPort != 0 {
+		// Prometheus scrapes /metrics, the ops dashboard reads /clients
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			handleMetrics(server, w, r)
+		})
+		mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+			handleClients(server, w, r)
+		})
+		listener, err := net.Listen("tcp", net.JoinHostPort(*adminAddr, strconv.Itoa(*adminPort)))
+		if err != nil {
+			logger.Fatalf("Failed to start admin endpoint: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("Admin endpoint started on %s at /metrics and /clients", listener.Addr())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Printf("Admin endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	if *linkPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *linkPort))
+		if err != nil {
+			logger.Fatalf("Failed to start link listener: %v", err)
+		}
+		listeners = append(listeners, listener)
+
+		logger.Printf("Server %s accepting links on port %d", *serverName, *linkPort)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveLinks(server, listener)
+		}()
+	}
+	for _, address := range strings.Split(*links, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			go server.maintainLink(address)
+		}
+	}
+
+	// Run until interrupted, then shut down gracefully
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	logger.Printf("Received %v, shutting down", sig)
+
+	// A second signal skips the drain
+	go func() {
+		<-sigCh
+		logger.Fatalf("Received second signal, exiting immediately")
+	}()
 
-	// Accept incoming connections
+	// Stop accepting connections before draining the existing ones
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	wg.Wait()
+
+	summary := server.Shutdown(*shutdownMessage, *drainTimeout)
+	logger.Printf("Shutdown complete in %v: %d connections (%d users), %d messages flushed, %d unsent, %d connections timed out",
+		summary.Duration.Round(time.Millisecond), summary.Connections, summary.Users,
+		summary.Flushed, summary.Unsent, summary.TimedOut)
+}
+
+// serve accepts incoming connections on a listener until it is closed
+func serve(server *Server, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
-			logger.Printf("Error accepting connection: %v", err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			server.logger.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
 		go handleConnection(server, conn)
 	}
-}
\ No newline at end of file
+}
+
+// loadTLSConfig builds the server TLS configuration, when clientCA is set
+// clients may authenticate with a certificate signed by that CA
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCA)
+		}
+		// Client certificates are optional, users without one use /NICK as usual
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -0,0 +1,2047 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server keeping its state in a temporary
+// directory, with no rate limits and nothing held for a resume
+func newTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	t.Helper()
+	config := Config{
+		DataDir:        t.TempDir(),
+		MailboxCap:     10,
+		MailboxTTL:     time.Hour,
+		HistoryMaxSize: 1 << 20,
+		IgnoreMode:     IgnoreDrop,
+		SlowPolicy:     PolicyDrop,
+		BlockTimeout:   50 * time.Millisecond,
+		MaxViolations:  10,
+		ServerName:     "test",
+	}
+	for _, f := range configure {
+		f(&config)
+	}
+	server, err := NewServer(log.New(io.Discard, "", 0), config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return server
+}
+
+// newTestClient creates a client whose events stay in its outCh for the
+// test to read, there is no writer goroutine
+func newTestClient(t *testing.T, server *Server) *Client {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	// Nothing reads the other end, so writes such as a disconnect notice give up at once
+	conn.SetWriteDeadline(time.Now())
+	return &Client{
+		conn:   conn,
+		outCh:  make(chan Event, 10),
+		fileCh: make(chan Event, 4),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		limits: newRateLimits(server.config),
+	}
+}
+
+// register connects a test client under a nickname
+func register(t *testing.T, server *Server, nickname string) *Client {
+	t.Helper()
+	client := newTestClient(t, server)
+	if ok, msg := server.RegisterClient(nickname, client); !ok {
+		t.Fatalf("RegisterClient(%s): %s", nickname, msg)
+	}
+	drain(client)
+	return client
+}
+
+// drain returns the events queued for a client
+func drain(client *Client) []Event {
+	var events []Event
+	for {
+		select {
+		case ev, ok := <-client.outCh:
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+// bodies returns the bodies of events of one type
+func bodies(events []Event, kind string) []string {
+	var found []string
+	for _, ev := range events {
+		if ev.Type == kind {
+			found = append(found, ev.Body)
+		}
+	}
+	return found
+}
+
+// join puts users in a room, failing the test if one can't join
+func join(t *testing.T, server *Server, room string, nicknames ...string) {
+	t.Helper()
+	for _, nick := range nicknames {
+		if ok, msg := server.JoinRoom(nick, room); !ok {
+			t.Fatalf("JoinRoom(%s, %s): %s", nick, room, msg)
+		}
+	}
+}
+
+// members returns the sorted members of a room, nil if it doesn't exist
+func members(server *Server, room string) []string {
+	_, list, exists := server.RoomInfo(room)
+	if !exists {
+		return nil
+	}
+	return list
+}
+
+func TestJoinAndPartRoom(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+
+	join(t, server, "#go", "bob", "alice")
+	if got := members(server, "#go"); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("members = %v, want [alice bob]", got)
+	}
+	if got := bodies(drain(bob), "notice"); !slices.Equal(got, []string{"*** alice joined #go"}) {
+		t.Errorf("bob was told %v", got)
+	}
+
+	if ok, _ := server.JoinRoom("alice", "#go"); ok {
+		t.Error("joined the same room twice")
+	}
+	if ok, _ := server.JoinRoom("alice", "go"); ok {
+		t.Error("joined a room without a leading #")
+	}
+
+	if ok, msg := server.PartRoom("alice", "#go"); !ok {
+		t.Fatalf("PartRoom: %s", msg)
+	}
+	if ok, _ := server.PartRoom("alice", "#go"); ok {
+		t.Error("left a room twice")
+	}
+	if ok, msg := server.PartRoom("bob", "#go"); !ok {
+		t.Fatalf("PartRoom: %s", msg)
+	}
+	if got := members(server, "#go"); got != nil {
+		t.Errorf("empty room still exists with %v", got)
+	}
+}
+
+func TestDisconnectLeavesRooms(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	join(t, server, "#go", "alice", "bob")
+	join(t, server, "#chat", "alice")
+	drain(bob)
+
+	server.UnregisterClient("alice")
+
+	if got := members(server, "#go"); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("#go members = %v, want [bob]", got)
+	}
+	if got := members(server, "#chat"); got != nil {
+		t.Errorf("#chat should have closed, has %v", got)
+	}
+	if got := bodies(drain(bob), "notice"); !slices.Equal(got, []string{"*** alice left #go"}) {
+		t.Errorf("bob was told %v", got)
+	}
+
+	// The nickname and the room are free for someone else
+	register(t, server, "alice")
+	join(t, server, "#chat", "alice")
+}
+
+func TestNickChangeKeepsRooms(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	join(t, server, "#go", "alice", "bob")
+	drain(bob)
+
+	if ok, msg := server.ChangeNickname("alice", "alicia", alice); !ok {
+		t.Fatalf("ChangeNickname: %s", msg)
+	}
+	if got := members(server, "#go"); !slices.Equal(got, []string{"alicia", "bob"}) {
+		t.Errorf("members = %v, want [alicia bob]", got)
+	}
+	if got := bodies(drain(bob), "notice"); !slices.Equal(got, []string{"*** alice is now known as alicia"}) {
+		t.Errorf("bob was told %v", got)
+	}
+
+	// Messages to the room reach the member under the new name
+	if result := server.SendMessage("bob", "#go", "hi"); !slices.Equal(result.Success, []string{"#go"}) {
+		t.Fatalf("SendMessage = %+v", result)
+	}
+	if got := bodies(drain(alice), "message"); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("alicia received %v", got)
+	}
+
+	if ok, _ := server.ChangeNickname("alicia", "bob", alice); ok {
+		t.Error("changed to a nickname in use")
+	}
+}
+
+func TestSendMessageRouting(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	join(t, server, "#go", "alice", "bob")
+	drain(alice)
+
+	tests := []struct {
+		name       string
+		recipients string
+		success    []string
+		failed     []string
+		receivers  []*Client
+	}{
+		{"direct", "bob", []string{"bob"}, nil, []*Client{bob}},
+		{"several", "bob, carol", []string{"bob", "carol"}, nil, []*Client{bob, carol}},
+		{"unknown", "bob,dave", []string{"bob"}, []string{"dave"}, []*Client{bob}},
+		{"broadcast", "*", []string{"bob", "carol"}, nil, []*Client{bob, carol}},
+		{"room", "#go", []string{"#go"}, nil, []*Client{bob}},
+		{"room not joined", "#rust", nil, []string{"#rust"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := server.SendMessage("alice", tt.recipients, "hello")
+			slices.Sort(result.Success)
+			if !slices.Equal(result.Success, tt.success) || !slices.Equal(result.Failed, tt.failed) {
+				t.Errorf("success %v failed %v, want %v and %v", result.Success, result.Failed, tt.success, tt.failed)
+			}
+			for _, c := range []*Client{alice, bob, carol} {
+				got := bodies(drain(c), "message")
+				want := 0
+				if slices.Contains(tt.receivers, c) {
+					want = 1
+				}
+				if len(got) != want {
+					t.Errorf("%s received %v", c.nickname, got)
+				}
+			}
+		})
+	}
+
+	// The sender and the recipient both find the message in their history
+	entries, err := server.History("bob", "alice", time.Time{}, 10)
+	if err != nil || len(entries) == 0 || !strings.Contains(entries[0].Body, "hello") {
+		t.Errorf("History = %v, %v", entries, err)
+	}
+}
+
+func TestHistoryOfAPreviousHolderIsHidden(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ReserveNicks = true })
+	register(t, server, "alice")
+	register(t, server, "bob")
+	server.SendMessage("alice", "bob", "secret for bob")
+	server.UnregisterClient("bob")
+
+	// Someone else takes the unregistered nickname and asks for everything
+	time.Sleep(10 * time.Millisecond)
+	impostor := register(t, server, "bob")
+	ctx := &CommandContext{Server: server, Client: impostor, Nickname: "bob"}
+	if reply := server.commands.Dispatch(ctx, "/HISTORY * 200"); strings.Contains(reply.Message, "secret") {
+		t.Errorf("the new holder of bob read %q", reply.Message)
+	}
+	server.UnregisterClient("bob")
+
+	// The owner of a registered nickname sees what was logged before they signed on
+	if err := server.accounts.Register("carol", "password"); err != nil {
+		t.Fatal(err)
+	}
+	owner := newTestClient(t, server)
+	owner.account = "carol"
+	if ok, msg := server.RegisterClient("carol", owner); !ok {
+		t.Fatalf("RegisterClient: %s", msg)
+	}
+	server.SendMessage("alice", "carol", "note for carol")
+	server.UnregisterClient("carol")
+	ctx = &CommandContext{Server: server, Client: newTestClient(t, server)}
+	if reply := server.commands.Dispatch(ctx, "/IDENTIFY carol password"); reply.Status != StatusOK {
+		t.Fatalf("IDENTIFY = %+v", reply)
+	}
+	if reply := server.commands.Dispatch(ctx, "/HISTORY alice"); !strings.Contains(reply.Message, "note for carol") {
+		t.Errorf("carol's history = %q, want the note", reply.Message)
+	}
+}
+
+func TestSlowClientsAreDisconnected(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.SlowPolicy = PolicyDisconnect
+		c.MaxOverflows = 2
+		c.ResumeGrace = time.Minute
+	})
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+
+	for i := 0; i < cap(bob.outCh)+2; i++ {
+		server.SendMessage("alice", "bob", "spam")
+	}
+	if _, err := bob.conn.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("the slow client is still connected")
+	}
+
+	// As with a kick, the nickname is let go instead of held for a resume
+	server.Detach("bob", bob)
+	if _, ok, _ := server.Resume(bob.resumeToken, newTestClient(t, server)); ok {
+		t.Error("a disconnected slow client resumed its session")
+	}
+	if ok, msg := server.RegisterClient("bob", newTestClient(t, server)); !ok {
+		t.Errorf("RegisterClient(bob): %s", msg)
+	}
+}
+
+func TestHistoryReadsRotatedLogs(t *testing.T) {
+	h, err := NewHistory(filepath.Join(t.TempDir(), "history.log"), 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		h.Append(HistoryEntry{From: "alice", Body: strconv.Itoa(i)})
+	}
+
+	// Appends carry on while the logs are read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 20; i < 40; i++ {
+			h.Append(HistoryEntry{From: "bob", Body: strconv.Itoa(i)})
+		}
+	}()
+	entries, err := h.Recent(3, func(e HistoryEntry) bool { return e.From == "alice" })
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Body)
+	}
+	if !slices.Equal(got, []string{"17", "18", "19"}) {
+		t.Errorf("Recent = %v", got)
+	}
+}
+
+func TestHistorySurvivesAResume(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ResumeGrace = time.Minute })
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	server.SendMessage("alice", "bob", "before the drop")
+	server.Detach("bob", bob)
+
+	// The session is the same user's, so is everything logged before the drop
+	time.Sleep(10 * time.Millisecond)
+	again := newTestClient(t, server)
+	if _, ok, msg := server.Resume(bob.resumeToken, again); !ok {
+		t.Fatalf("Resume: %s", msg)
+	}
+	ctx := &CommandContext{Server: server, Client: again, Nickname: "bob"}
+	if reply := server.commands.Dispatch(ctx, "/HISTORY alice"); !strings.Contains(reply.Message, "before the drop") {
+		t.Errorf("bob's history = %q", reply.Message)
+	}
+}
+
+// fill queues events for a client until its outCh is full
+func fill(client *Client) {
+	for len(client.outCh) < cap(client.outCh) {
+		client.outCh <- Event{Type: "notice", Body: "filler"}
+	}
+}
+
+func TestBlockPolicyDoesNotHoldTheLock(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.SlowPolicy = PolicyBlock
+		c.BlockTimeout = 300 * time.Millisecond
+	})
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	fill(bob)
+
+	sent := make(chan SendResult)
+	go func() { sent <- server.SendMessage("alice", "bob", "hi") }()
+
+	// Joining a room takes the server lock for writing while alice waits for bob
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	join(t, server, "#go", "alice")
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("JoinRoom waited %v for a slow reader", waited)
+	}
+
+	// Room for the message opens up while the sender is still waiting
+	<-bob.outCh
+	result := <-sent
+	if !slices.Equal(result.Success, []string{"bob"}) {
+		t.Errorf("SendMessage = %+v, want bob to get the message", result)
+	}
+	if got := bodies(drain(bob), "message"); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("bob received %v", got)
+	}
+}
+
+func TestBlockPolicyTimesOut(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.SlowPolicy = PolicyBlock
+		c.BlockTimeout = 20 * time.Millisecond
+	})
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	fill(bob)
+
+	if result := server.SendMessage("alice", "bob", "hi"); !slices.Equal(result.Failed, []string{"bob"}) {
+		t.Errorf("SendMessage = %+v, want bob to fail", result)
+	}
+	if stats, _ := server.Stats("bob"); stats.Dropped != 1 || stats.Overflows != 1 {
+		t.Errorf("Stats = %+v, want one drop and one overflow", stats)
+	}
+}
+
+// track makes a test client a connection of the server, with a stand-in
+// for its writer and handler that finishes when shutdown asks it to
+func track(t *testing.T, server *Server, client *Client) {
+	t.Helper()
+	if !server.addConn(client) {
+		t.Fatal("addConn refused the connection")
+	}
+	go func() {
+		<-client.quit
+		close(client.done)
+		server.removeConn(client)
+	}()
+}
+
+func TestShutdown(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	track(t, server, alice)
+
+	// Bob's handler finishes just before the shutdown, closing his queue
+	if !server.addConn(bob) {
+		t.Fatal("addConn refused the connection")
+	}
+	server.UnregisterClient("bob")
+	server.removeConn(bob)
+
+	summary := server.Shutdown("*** Server is shutting down", time.Second)
+	if summary.Connections != 1 || summary.Users != 1 || summary.TimedOut != 0 {
+		t.Errorf("summary = %+v, want alice alone", summary)
+	}
+	if got := bodies(drain(alice), "notice"); !slices.Equal(got, []string{"*** Server is shutting down"}) {
+		t.Errorf("alice was told %v", got)
+	}
+
+	// Nothing is queued after the notice
+	if server.deliver("alice", alice, Event{Type: "notice", Body: "late"}) {
+		t.Error("a delivery after shutdown was accepted")
+	}
+	if server.addConn(newTestClient(t, server)) {
+		t.Error("a connection was accepted after shutdown")
+	}
+}
+
+func TestDeliverToClosedClient(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	alice.closeOut()
+
+	if server.deliver("alice", alice, Event{Type: "notice", Body: "hi"}) {
+		t.Error("delivered to a closed queue")
+	}
+	if stats, _ := server.Stats("alice"); stats.Dropped != 0 {
+		t.Errorf("a closed connection counted as slow: %+v", stats)
+	}
+}
+
+func TestOfflineMessagesAreQueued(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.MailboxCap = 2 })
+	register(t, server, "alice")
+	register(t, server, "bob")
+	server.UnregisterClient("bob")
+
+	for i, want := range []struct{ queued, failed []string }{
+		{[]string{"bob"}, []string{"dave"}},
+		{[]string{"bob"}, []string{"dave"}},
+		{nil, []string{"bob", "dave"}}, // bob's mailbox is full
+	} {
+		result := server.SendMessage("alice", "bob,dave", fmt.Sprintf("message %d", i+1))
+		slices.Sort(result.Failed)
+		if !slices.Equal(result.Queued, want.queued) || !slices.Equal(result.Failed, want.failed) {
+			t.Errorf("message %d: queued %v failed %v, want %v and %v", i+1, result.Queued, result.Failed, want.queued, want.failed)
+		}
+	}
+
+	// The mailbox survives a restart and is delivered in order on registration
+	restarted := newTestServer(t, func(c *Config) { c.DataDir = server.config.DataDir })
+	bob := newTestClient(t, restarted)
+	if ok, msg := restarted.RegisterClient("bob", bob); !ok || !strings.Contains(msg, "2 offline message(s)") {
+		t.Fatalf("RegisterClient = %v, %s", ok, msg)
+	}
+	var got []string
+	for _, ev := range drain(bob) {
+		if ev.Type == "message" && ev.Offline && ev.From == "alice" {
+			got = append(got, ev.Body)
+		}
+	}
+	if !slices.Equal(got, []string{"message 1", "message 2"}) {
+		t.Errorf("bob received %v", got)
+	}
+}
+
+func TestUnsavedOfflineMessageFails(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	register(t, server, "bob")
+	server.UnregisterClient("bob")
+
+	// The mailbox can no longer be written
+	server.mailbox.path = filepath.Join(t.TempDir(), "missing", "mailbox.json")
+	if result := server.SendMessage("alice", "bob", "hi"); !slices.Equal(result.Failed, []string{"bob"}) || result.Queued != nil {
+		t.Errorf("SendMessage = %+v, want bob to fail", result)
+	}
+	if messages, _ := server.mailbox.Take("bob"); len(messages) != 0 {
+		t.Errorf("the failed message was kept: %v", messages)
+	}
+}
+
+func TestRegisteredNicknamesAreReserved(t *testing.T) {
+	for _, reserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reserve=%v", reserve), func(t *testing.T) {
+			server := newTestServer(t, func(c *Config) { c.ReserveNicks = reserve })
+			if err := server.accounts.Register("alice", "secret"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Taking the nickname directly and switching to it follow the same rule
+			registered, _ := server.RegisterClient("alice", newTestClient(t, server))
+			if registered {
+				server.UnregisterClient("alice")
+			}
+			bob := register(t, server, "bob")
+			changed, _ := server.ChangeNickname("bob", "alice", bob)
+			if registered == reserve || changed == reserve {
+				t.Errorf("RegisterClient %v, ChangeNickname %v, want both %v", registered, changed, !reserve)
+			}
+
+			// The owner may always use it
+			owner := newTestClient(t, server)
+			owner.account = "alice"
+			if !changed {
+				server.UnregisterClient("bob")
+			} else {
+				server.UnregisterClient("alice")
+			}
+			if ok, msg := server.RegisterClient("alice", owner); !ok {
+				t.Errorf("the owner could not register: %s", msg)
+			}
+		})
+	}
+}
+
+func TestIdentifyDisconnectsGuessers(t *testing.T) {
+	server := newTestServer(t)
+	if err := server.accounts.Register("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, server)
+
+	for attempt := 1; attempt <= maxIdentifyFailures; attempt++ {
+		ctx := &CommandContext{Server: server, Client: client}
+		reply := server.commands.Dispatch(ctx, "/IDENTIFY alice guess")
+		if reply.Status != StatusUnauthorized {
+			t.Fatalf("attempt %d: %+v", attempt, reply)
+		}
+		if ctx.disconnect != (attempt == maxIdentifyFailures) {
+			t.Errorf("attempt %d: disconnect = %v", attempt, ctx.disconnect)
+		}
+	}
+
+	// A fresh connection with the right password is let in
+	ctx := &CommandContext{Server: server, Client: newTestClient(t, server)}
+	if reply := server.commands.Dispatch(ctx, "/IDENTIFY alice secret"); reply.Status != StatusOK || ctx.Nickname != "alice" {
+		t.Errorf("IDENTIFY = %+v as %q", reply, ctx.Nickname)
+	}
+}
+
+func TestDispatchArity(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "bob")
+
+	tests := []struct {
+		line   string
+		status int
+	}{
+		{"/NICK", StatusBadRequest},
+		{"/NICK alice extra words", StatusOK}, // Extra words were always ignored
+		{"/LIST everyone please", StatusOK},
+		{"/JOIN #go #rust", StatusBadRequest},
+		{"/MSG bob hello there", StatusOK},
+		{"/msg bob hi", StatusOK},
+		{"/M", StatusBadRequest},
+		{"/KICK bob", StatusForbidden},
+		{"/NOPE", StatusBadRequest},
+		{"NICK alice", StatusBadRequest},
+	}
+	client := newTestClient(t, server)
+	ctx := &CommandContext{Server: server, Client: client}
+	for _, tt := range tests {
+		reply := server.commands.Dispatch(ctx, tt.line)
+		if reply.Status != tt.status {
+			t.Errorf("%s = %d %q, want %d", tt.line, reply.Status, reply.Message, tt.status)
+		}
+	}
+	if ctx.Nickname != "alice" {
+		t.Errorf("nickname = %q, want alice", ctx.Nickname)
+	}
+}
+
+func TestFailedIdentifyKeepsNoAccount(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ReserveNicks = true })
+	if err := server.accounts.Register("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	server.operators["alice"] = true
+	owner := newTestClient(t, server)
+	if reply := server.commands.Dispatch(&CommandContext{Server: server, Client: owner}, "/IDENTIFY alice secret"); reply.Status != StatusOK {
+		t.Fatalf("IDENTIFY = %+v", reply)
+	}
+
+	// A second connection knows the password, but the nickname is taken
+	bob := register(t, server, "bob")
+	ctx := &CommandContext{Server: server, Client: bob, Nickname: "bob"}
+	if reply := server.commands.Dispatch(ctx, "/IDENTIFY alice secret"); reply.Status == StatusOK {
+		t.Errorf("IDENTIFY = %+v, want a failure", reply)
+	}
+	if ctx.Nickname != "bob" || bob.account != "" {
+		t.Errorf("after a failed identify: nickname %q, account %q", ctx.Nickname, bob.account)
+	}
+	if server.IsOperator(bob) {
+		t.Error("bob gained operator rights")
+	}
+}
+
+func TestMuteFollowsNicknameChange(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+
+	if ok, _ := server.Mute("nobody", "alice", 0); ok {
+		t.Error("muted a user who isn't connected")
+	}
+	if ok, msg := server.Mute("bob", "alice", 0); !ok {
+		t.Fatalf("Mute: %s", msg)
+	}
+	if ok, msg := server.ChangeNickname("bob", "robert", bob); !ok {
+		t.Fatalf("ChangeNickname: %s", msg)
+	}
+	if result := server.SendMessage("robert", "alice", "hi"); result.Rejected == "" {
+		t.Errorf("a muted user got through under a new nickname: %+v", result)
+	}
+
+	// The old nickname is free of the mute, the new one can be unmuted
+	if ok, _ := server.Unmute("bob", "alice"); ok {
+		t.Error("the mute stayed on the old nickname")
+	}
+	if ok, msg := server.Unmute("robert", "alice"); !ok {
+		t.Fatalf("Unmute: %s", msg)
+	}
+	if result := server.SendMessage("robert", "alice", "hi"); result.Rejected != "" {
+		t.Errorf("SendMessage after unmuting = %+v", result)
+	}
+}
+
+func TestKickQueuesNotice(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+
+	if ok, msg := server.Kick("bob", "alice", "spam"); !ok {
+		t.Fatalf("Kick: %s", msg)
+	}
+	// The notice waits in bob's queue for his writer, which then closes the connection
+	if got := bodies(drain(bob), "notice"); !slices.Equal(got, []string{"*** You were kicked by alice: spam"}) {
+		t.Errorf("bob was told %v", got)
+	}
+	if _, open := bob.offer(Event{Type: "notice", Body: "late"}, 0); open {
+		t.Error("bob's queue is still open after the kick")
+	}
+	if !bob.noResume.Load() {
+		t.Error("a kicked user may resume")
+	}
+}
+
+func TestNicknameChangesRaceNothing(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	track(t, server, alice)
+
+	// Readers of the nickname run while it changes, go test -race checks the locking
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			server.Ban("mallory", "op", time.Minute, "")
+			server.Clients()
+			server.Ignore(alice, "mallory", i%2 == 0)
+		}
+	}()
+	nick := "alice"
+	for i := 0; i < 50; i++ {
+		next := fmt.Sprintf("alice%d", i)
+		if ok, msg := server.ChangeNickname(nick, next, alice); !ok {
+			t.Fatalf("ChangeNickname: %s", msg)
+		}
+		nick = next
+	}
+	<-done
+
+	if got := server.nicknameOf(alice); got != nick {
+		t.Errorf("nickname = %q, want %q", got, nick)
+	}
+}
+
+// newTestLink creates a link to a server named name whose frames stay in
+// its outCh for the test to read
+func newTestLink(t *testing.T, server *Server, name string) *Link {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	link := &Link{name: name, conn: conn}
+	if !server.addLink(link) {
+		t.Fatalf("addLink(%s) refused", name)
+	}
+	return link
+}
+
+func TestLinkCyclesRefused(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+
+	// Server b is linked to c, and passes on its users
+	b := newTestLink(t, server, "b")
+	server.handleLinkFrame(b, linkFrame{Type: "user", Nick: "bob", Server: "b", Since: 1})
+	server.handleLinkFrame(b, linkFrame{Type: "user", Nick: "carol", Server: "c", Since: 1})
+
+	// A direct link to c would close the triangle
+	if server.addLink(&Link{name: "c", conn: &recordConn{}}) {
+		t.Error("linked with a server already reached through b")
+	}
+
+	// A link that turns out to reach c or this server again is dropped
+	for _, f := range []linkFrame{
+		{Type: "user", Nick: "carol", Server: "c", Since: 1},
+		{Type: "user", Nick: "alice", Server: "test", Since: 1},
+	} {
+		d := newTestLink(t, server, "d")
+		server.handleLinkFrame(d, f)
+		d.conn.SetWriteDeadline(time.Now())
+		if _, err := d.conn.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("the link stayed up after announcing %s on server %s", f.Nick, f.Server)
+		}
+		server.removeLink(d)
+	}
+	if user := server.remote["carol"]; user == nil || user.link != b {
+		t.Errorf("carol is reached through %+v", user)
+	}
+}
+
+func TestLinkNickCollision(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	join(t, server, "#go", "alice", "bob")
+	link := newTestLink(t, server, "other")
+	drain(bob)
+
+	// A user who took the nickname later on the other server loses
+	since := alice.signon.UnixNano()
+	server.handleLinkFrame(link, linkFrame{Type: "user", Nick: "alice", Server: "other", Since: since + 1})
+	if got := members(server, "#go"); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("the local user lost a collision it won, #go has %v", got)
+	}
+
+	// One who took it first wins, the local user is dropped from everything
+	server.handleLinkFrame(link, linkFrame{Type: "user", Nick: "alice", Server: "other", Since: since - 1})
+	if got := members(server, "#go"); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("#go members = %v, want [bob]", got)
+	}
+	if got := bodies(drain(bob), "notice"); !slices.Equal(got, []string{"*** alice left #go"}) {
+		t.Errorf("bob was told %v", got)
+	}
+	if user, _ := server.Whois("alice"); user.Server != "other" {
+		t.Errorf("Whois(alice) = %+v, want the user on other", user)
+	}
+
+	// The loser's handler closes its queue, later room messages don't reach it
+	server.Detach("alice", alice)
+	server.release(alice)
+	if result := server.SendMessage("bob", "#go", "hi"); !slices.Equal(result.Success, []string{"#go"}) {
+		t.Errorf("SendMessage = %+v", result)
+	}
+}
+
+func TestResumeRefusedWhileTakenRemotely(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ResumeGrace = time.Minute })
+	alice := register(t, server, "alice")
+	token := alice.resumeToken
+	server.Detach("alice", alice)
+	link := newTestLink(t, server, "other")
+
+	// The other server doesn't know alice is held here and lets one of its users take it
+	server.handleLinkFrame(link, linkFrame{Type: "user", Nick: "alice", Server: "other", Since: time.Now().UnixNano()})
+	if _, ok, msg := server.Resume(token, newTestClient(t, server)); ok {
+		t.Fatal("resumed a nickname held by a remote user")
+	} else if msg != "Resume failed: alice was taken on server other" {
+		t.Errorf("Resume = %q", msg)
+	}
+
+	// The session is still held once they leave
+	server.handleLinkFrame(link, linkFrame{Type: "quit", Nick: "alice", Server: "other"})
+	if nick, ok, msg := server.Resume(token, newTestClient(t, server)); !ok || nick != "alice" {
+		t.Errorf("Resume = %q, %v, %q", nick, ok, msg)
+	}
+}
+
+func TestResumeRefusedOnceBanned(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ResumeGrace = time.Minute })
+	alice := register(t, server, "alice")
+	token := alice.resumeToken
+	server.Detach("alice", alice)
+
+	// Banning the nickname ends the held session
+	server.Ban("alice", "op", 0, "spam")
+	if _, ok, _ := server.Resume(token, newTestClient(t, server)); ok {
+		t.Error("resumed a banned nickname")
+	}
+	server.mu.RLock()
+	_, held := server.held["alice"]
+	server.mu.RUnlock()
+	if held {
+		t.Error("the banned nickname is still held")
+	}
+
+	// A ban that missed the held session still keeps it from being resumed
+	bob := register(t, server, "bob")
+	token = bob.resumeToken
+	server.Detach("bob", bob)
+	server.bans.Add(Ban{Mask: "bob", By: "op"})
+	if _, ok, msg := server.Resume(token, newTestClient(t, server)); ok {
+		t.Error("resumed a banned nickname")
+	} else if msg != "Resume failed: bob is banned" {
+		t.Errorf("Resume = %q", msg)
+	}
+}
+
+func TestRefilledBudgetsAreDropped(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.DMRate = 10
+		c.DMBurst = 1
+	})
+	client := newTestClient(t, server)
+	for i := 0; i < 100; i++ {
+		client.limits = newRateLimits(server.config)
+		server.AllowMessage(client, fmt.Sprintf("user%d", i), false)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// bob's budget is still used up at the next sweep, the others have refilled
+	client.limits = newRateLimits(server.config)
+	server.AllowMessage(client, "bob", false)
+	server.limitsMu.Lock()
+	server.limitsSwept = time.Time{}
+	server.limitsMu.Unlock()
+	client.limits = newRateLimits(server.config)
+	if ok, _ := server.AllowMessage(client, "bob", false); ok {
+		t.Error("bob's budget was reset")
+	}
+	server.limitsMu.Lock()
+	defer server.limitsMu.Unlock()
+	if len(server.nickLimits) != 1 {
+		t.Errorf("%d budgets kept, want only bob's", len(server.nickLimits))
+	}
+}
+
+func TestEchoBotsRunOutOfBudget(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.DMRate = 0.001
+		c.DMBurst = 5
+	})
+	ping, err := server.AddBot("ping", EchoBot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AddBot("pong", EchoBot{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each bot echoes what the other sends, until one of them is out of budget
+	ping.Send("pong", "hello")
+	var routed int64
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		now := server.metrics.routed.Load()
+		if now == routed {
+			break
+		}
+		routed = now
+	}
+	if routed == 0 || routed > 10 {
+		t.Errorf("bots sent %d messages, want 1 to 10 with a burst of 5 each", routed)
+	}
+	if result := ping.Send("pong", "again"); result.Rejected == "" {
+		t.Errorf("Send past the burst was not rejected: %+v", result)
+	}
+}
+
+func TestSendWaitKeepsEveryMessage(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.DMRate = 10
+		c.DMBurst = 1
+	})
+	relay, err := server.AddBot("relay", &RelayBot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+
+	// Past the burst Send drops alerts, SendWait holds them until there is budget
+	for i := 1; i <= 3; i++ {
+		if result := relay.SendWait("alice", fmt.Sprintf("alert %d", i)); result.Rejected != "" {
+			t.Fatalf("SendWait: %s", result.Rejected)
+		}
+	}
+	if got := bodies(drain(alice), "message"); !slices.Equal(got, []string{"alert 1", "alert 2", "alert 3"}) {
+		t.Errorf("alice received %v", got)
+	}
+
+	// A stopped bot stops waiting
+	relay.Send("alice", "spend the budget")
+	relay.stop()
+	if result := relay.SendWait("alice", "late"); result.Rejected == "" {
+		t.Errorf("SendWait after stop = %+v", result)
+	}
+}
+
+func TestReminderForgetsFiredTimers(t *testing.T) {
+	server := newTestServer(t)
+	reminder := &ReminderBot{}
+	if _, err := server.AddBot("remind", reminder); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+
+	server.SendMessage("alice", "remind", "10ms stretch")
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && !slices.Contains(got, "Reminder: stretch"); {
+		time.Sleep(10 * time.Millisecond)
+		got = append(got, bodies(drain(alice), "message")...)
+	}
+	if !slices.Contains(got, "Reminder: stretch") {
+		t.Fatalf("alice got %q, want the reminder", got)
+	}
+
+	reminder.mu.Lock()
+	defer reminder.mu.Unlock()
+	if len(reminder.pending) != 0 {
+		t.Errorf("pending = %v after the reminder fired, want it empty", reminder.pending)
+	}
+}
+
+// newTestIRCConn creates a registered IRC connection and collects the
+// lines it writes back to the client
+func newTestIRCConn(t *testing.T, server *Server) (*ircConn, func() string) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	written := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(peer)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			written <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+
+	c := newIRCConn(server, conn)
+	c.nickname, c.user, c.registered = "alice", true, true
+	next := func() string {
+		select {
+		case line := <-written:
+			return line
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	return c, next
+}
+
+func TestTranslateWhois(t *testing.T) {
+	server := newTestServer(t)
+	c, next := newTestIRCConn(t, server)
+
+	for _, line := range []string{"WHOIS\r\n", "WHOIS :\r\n"} {
+		if frames := c.translate(line); frames != nil {
+			t.Errorf("translate(%q) = %q, want no request", line, frames)
+		}
+		if got, want := next(), ":test 431 alice :No nickname given"; got != want {
+			t.Errorf("translate(%q) wrote %q, want %q", line, got, want)
+		}
+	}
+
+	// A server may come before the nickname
+	for _, line := range []string{"WHOIS bob\r\n", "WHOIS test bob\r\n"} {
+		if got, want := string(c.translate(line)), string(ircRequest("irc:whois:bob", "WHOIS", "bob")); got != want {
+			t.Errorf("translate(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestParseIRC(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"", "", nil},
+		{"\r\n", "", nil},
+		{"ping\r\n", "PING", nil},
+		{"NICK alice\r\n", "NICK", []string{"alice"}},
+		{":alice!a@host PRIVMSG #go :hello there\r\n", "PRIVMSG", []string{"#go", "hello there"}},
+		{"PRIVMSG  bob   :  spaced  \n", "PRIVMSG", []string{"bob", "  spaced  "}},
+		{"TOPIC #go :\r\n", "TOPIC", []string{"#go", ""}},
+		{"USER alice 0 * :Alice Liddell", "USER", []string{"alice", "0", "*", "Alice Liddell"}},
+		{":server.only\r\n", "", nil},
+	}
+	for _, tt := range tests {
+		command, params := parseIRC(tt.line)
+		if command != tt.command || !slices.Equal(params, tt.params) {
+			t.Errorf("parseIRC(%q) = %q, %q, want %q, %q", tt.line, command, params, tt.command, tt.params)
+		}
+	}
+}
+
+// startServer serves connections from a listener until the test ends
+func startServer(t *testing.T, server *Server, listener net.Listener) {
+	t.Helper()
+	go serve(server, listener)
+	t.Cleanup(func() {
+		listener.Close()
+		server.Shutdown("", time.Second)
+	})
+}
+
+// readLine reads a line the server wrote, failing the test if none comes
+func readLine(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading from the server: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// newTestCert issues a certificate named cn, signed by parent or by itself
+// when parent is nil, and writes it and its key as PEM into dir
+func newTestCert(t *testing.T, dir, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	os.WriteFile(filepath.Join(dir, cn+".pem"), certPEM, 0o600)
+	os.WriteFile(filepath.Join(dir, cn+".key"), keyPEM, 0o600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientCertificateNamesTheUser(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	newTestCert(t, dir, "server", &ca)
+	alice := newTestCert(t, dir, "alice", &ca)
+	stranger := newTestCert(t, dir, "mallory", nil)
+
+	config, err := loadTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t)
+	startServer(t, server, listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	dial := func(cert *tls.Certificate) (*tls.Conn, *bufio.Reader) {
+		// The certificate is sent even when the server won't accept its issuer
+		client := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			client.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+		if err != nil {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+
+	// A certificate from the client CA takes its CN as nickname and account
+	conn, r := dial(&alice)
+	if got := readLine(t, conn, r); !strings.HasPrefix(got, "Authenticated as alice by client certificate.") {
+		t.Fatalf("server said %q", got)
+	}
+	if user, online := server.Whois("alice"); !online || user.Account != "alice" {
+		t.Errorf("Whois(alice) = %+v, %v", user, online)
+	}
+
+	// Without one the client picks a nickname as usual
+	conn, r = dial(nil)
+	if got := readLine(t, conn, r); got != "Welcome to the Go Chat Server!" {
+		t.Errorf("server said %q", got)
+	}
+
+	// One from anyone else fails the handshake
+	conn, r = dial(&stranger)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("a client with an unknown certificate was told %q", line)
+	}
+	if _, online := server.Whois("mallory"); online {
+		t.Error("mallory is online")
+	}
+}
+
+// serveTCP serves a server on a local port until the test ends, returning its address
+func serveTCP(t *testing.T, server *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, server, listener)
+	return listener.Addr().String()
+}
+
+// dialText connects a text protocol client and reads past the welcome
+func dialText(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	readLine(t, conn, r)
+	readLine(t, conn, r)
+	return conn, r
+}
+
+// readFrame reads JSON protocol lines until a reply, returning it and the
+// events that came before it
+func readFrame(t *testing.T, conn net.Conn, r *bufio.Reader) (replyFrame, []Event) {
+	t.Helper()
+	var events []Event
+	for {
+		line := readLine(t, conn, r)
+		var frame replyFrame
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			t.Fatalf("%q is not a frame: %v", line, err)
+		}
+		if frame.Type == "reply" {
+			return frame, events
+		}
+		var ev Event
+		json.Unmarshal([]byte(line), &ev)
+		events = append(events, ev)
+	}
+}
+
+func TestJSONFrames(t *testing.T) {
+	server := newTestServer(t)
+	address := serveTCP(t, server)
+	alice, r := dialText(t, address)
+
+	// The reply to /PROTO is already a frame
+	fmt.Fprintf(alice, "/PROTO json\r\n")
+	if reply, _ := readFrame(t, alice, r); reply.Command != "PROTO" || reply.Status != StatusOK {
+		t.Fatalf("/PROTO json = %+v", reply)
+	}
+
+	// Replies carry the request's id and command
+	fmt.Fprintf(alice, `{"id": "1", "command": "n", "args": ["alice"]}`+"\r\n")
+	if reply, _ := readFrame(t, alice, r); reply.ID != "1" || reply.Command != "N" || reply.Status != StatusOK {
+		t.Errorf("nick = %+v", reply)
+	}
+	fmt.Fprintf(alice, `{"id": "2", "command": "join", "args": ["no room"]}`+"\r\n")
+	if reply, _ := readFrame(t, alice, r); reply.ID != "2" || reply.Status != StatusBadRequest {
+		t.Errorf("join = %+v", reply)
+	}
+	fmt.Fprintf(alice, "/NICK bob\r\n")
+	if reply, _ := readFrame(t, alice, r); reply.Status != StatusBadRequest || !strings.HasPrefix(reply.Message, "Invalid frame") {
+		t.Errorf("a text line in JSON mode got %+v", reply)
+	}
+
+	// Messages from a text client arrive as events
+	bob, rb := dialText(t, address)
+	fmt.Fprintf(bob, "/NICK bob\r\n/MSG alice hi there\r\n")
+	readLine(t, bob, rb)
+	readLine(t, bob, rb)
+	var ev Event
+	if err := json.Unmarshal([]byte(readLine(t, alice, r)), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != "message" || ev.From != "bob" || ev.To != "alice" || ev.Body != "hi there" {
+		t.Errorf("alice got %+v", ev)
+	}
+
+}
+
+// recordConn is a connection whose writes are kept for the test to read
+type recordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// wsFrame builds a frame as a client sends it, with a masked payload
+func wsFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// newTestWSConn creates a WebSocket connection that reads the given
+// frames from the client
+func newTestWSConn(frames ...[]byte) (*wsConn, *recordConn) {
+	conn := &recordConn{}
+	return &wsConn{Conn: conn, reader: bufio.NewReader(bytes.NewReader(slices.Concat(frames...)))}, conn
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	// A fragmented message is read whole, answering a ping in between
+	c, conn := newTestWSConn(
+		wsFrame(false, wsText, []byte("/MSG bob ")),
+		wsFrame(true, wsPing, []byte("ping")),
+		wsFrame(true, wsContinuation, []byte("hello")),
+	)
+	line := make([]byte, 64)
+	n, err := c.Read(line)
+	if err != nil || string(line[:n]) != "/MSG bob hello\n" {
+		t.Errorf("Read = %q, %v", line[:n], err)
+	}
+	if got, want := conn.out.Bytes(), []byte{0x8A, 4, 'p', 'i', 'n', 'g'}; !bytes.Equal(got, want) {
+		t.Errorf("pong = %v, want %v", got, want)
+	}
+
+	// Writes are single unmasked text frames without the line ending
+	conn.out.Reset()
+	c.Write([]byte("hi\r\n"))
+	if got, want := conn.out.Bytes(), []byte{0x81, 2, 'h', 'i'}; !bytes.Equal(got, want) {
+		t.Errorf("Write framed %v, want %v", got, want)
+	}
+	conn.out.Reset()
+	c.Write(bytes.Repeat([]byte("x"), 300))
+	if got, want := conn.out.Bytes()[:4], []byte{0x81, 126, 0x01, 0x2C}; !bytes.Equal(got, want) {
+		t.Errorf("a 300 byte message starts %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		reply []byte // Close frame the server answers with
+	}{
+		{"close", wsFrame(true, wsClose, []byte{0x03, 0xE8}), []byte{0x88, 2, 0x03, 0xE8}},
+		{"oversized", []byte{0x81, 0xFF, 0, 0, 0, 0, 0, 0x10, 0, 0}, []byte{0x88, 2, 0x03, 0xF1}},
+		{"unknown opcode", wsFrame(true, 0x3, nil), []byte{0x88, 2, 0x03, 0xEA}},
+	}
+	for _, tt := range tests {
+		c, conn := newTestWSConn(tt.frame)
+		if n, err := c.Read(make([]byte, 64)); err == nil {
+			t.Errorf("%s: Read = %d, want an error", tt.name, n)
+		}
+		if !bytes.Equal(conn.out.Bytes(), tt.reply) {
+			t.Errorf("%s: server answered %v, want %v", tt.name, conn.out.Bytes(), tt.reply)
+		}
+	}
+}
+
+func TestWebSocketHandshakeRefused(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"plain request", nil, http.StatusBadRequest},
+		{"no key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handleWebSocket(server, w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestFloodingDisconnects(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.DMRate, c.DMBurst = 0.001, 2
+		c.BroadcastRate, c.BroadcastBurst = 0.001, 1
+		c.MaxViolations = 3
+	})
+	register(t, server, "bob")
+	alice := register(t, server, "alice")
+	ctx := &CommandContext{Server: server, Client: alice, Nickname: "alice"}
+
+	for i := 0; i < 2; i++ {
+		if reply := server.commands.Dispatch(ctx, "/MSG bob hi"); reply.Status != StatusOK {
+			t.Fatalf("message %d = %+v", i, reply)
+		}
+	}
+	reply := server.commands.Dispatch(ctx, "/MSG bob hi")
+	if reply.Status != StatusTooMany || reply.Data["retry_after"] == nil {
+		t.Errorf("a message over the limit = %+v", reply)
+	}
+
+	// Broadcasts have a budget of their own
+	if reply := server.commands.Dispatch(ctx, "/MSG * hello"); reply.Status != StatusOK {
+		t.Errorf("broadcast = %+v", reply)
+	}
+
+	// A new connection under the same nickname starts with the nickname's spent budget
+	server.UnregisterClient("alice")
+	again := register(t, server, "alice")
+	ctx = &CommandContext{Server: server, Client: again, Nickname: "alice"}
+	for i := 1; i <= 3; i++ {
+		reply := server.commands.Dispatch(ctx, "/MSG bob hi")
+		if reply.Status != StatusTooMany {
+			t.Fatalf("message %d = %+v", i, reply)
+		}
+		if ctx.disconnect != (i == 3) {
+			t.Errorf("after %d violations: disconnect = %v", i, ctx.disconnect)
+		}
+		if i == 3 && !strings.HasSuffix(reply.Message, "Too many violations, disconnecting") {
+			t.Errorf("the flooder was told %q", reply.Message)
+		}
+	}
+}
+
+// waitClosed reads from a connection until the server closes it
+func waitClosed(t *testing.T, conn net.Conn, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("the server kept the connection open")
+		} else if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func TestUnansweredPingsDisconnect(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.PingInterval = 30 * time.Millisecond
+		c.MaxMissedPings = 2
+	})
+	conn, r := dialText(t, serveTCP(t, server))
+	fmt.Fprintf(conn, "/NICK alice\r\n")
+
+	// A client answering every PING stays well past the limit
+	for pings := 0; pings < 6; {
+		if token, ok := strings.CutPrefix(readLine(t, conn, r), "PING "); ok {
+			fmt.Fprintf(conn, "PONG %s\r\n", token)
+			pings++
+		}
+	}
+
+	// One that stops answering is dropped, and its nickname freed
+	for _, line := range waitClosed(t, conn, r) {
+		if !strings.HasPrefix(line, "PING ") {
+			t.Errorf("server said %q", line)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, online := server.Whois("alice"); !online {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("alice is still online")
+		}
+	}
+}
+
+func TestActiveClientsNeedNotAnswerPings(t *testing.T) {
+	server := newTestServer(t, func(c *Config) {
+		c.PingInterval = 30 * time.Millisecond
+		c.MaxMissedPings = 2
+	})
+	conn, r := dialText(t, serveTCP(t, server))
+	fmt.Fprintf(conn, "/NICK alice\r\n")
+
+	// Commands keep the client connected well past the limit without a PONG
+	go io.Copy(io.Discard, r)
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, err := fmt.Fprintf(conn, "/LIST\r\n"); err != nil {
+			t.Fatalf("the server dropped an active client: %v", err)
+		}
+	}
+	if _, online := server.Whois("alice"); !online {
+		t.Error("alice was disconnected while active")
+	}
+}
+
+func TestPongMatchesAPing(t *testing.T) {
+	client := &Client{}
+	client.pingSeq.Store(3)
+	for _, token := range []string{"4", "0", "-1", "three", ""} {
+		client.missedPings.Store(2)
+		client.pong(token)
+		if client.missedPings.Load() != 2 {
+			t.Errorf("PONG %q was taken as an answer", token)
+		}
+	}
+	// An answer to an earlier PING still shows the client is alive
+	client.pong("2")
+	if client.missedPings.Load() != 0 {
+		t.Error("PONG 2 was not taken as an answer")
+	}
+}
+
+func TestSilentClientsTimeOut(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ReadTimeout = 100 * time.Millisecond })
+	conn, r := dialText(t, serveTCP(t, server))
+
+	// Each command restarts the clock
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		fmt.Fprintf(conn, "/LIST\r\n")
+		readLine(t, conn, r)
+	}
+	start := time.Now()
+	waitClosed(t, conn, r)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("dropped after %v of silence", elapsed)
+	}
+}
+
+func TestAwayStatus(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	ctx := &CommandContext{Server: server, Client: bob, Nickname: "bob"}
+
+	if reply := server.commands.Dispatch(ctx, "/AWAY at lunch"); reply.Status != StatusOK {
+		t.Fatalf("AWAY = %+v", reply)
+	}
+	reply := server.commands.Dispatch(&CommandContext{Server: server, Client: alice, Nickname: "alice"}, "/WHOIS bob")
+	if p, _ := reply.Data["whois"].(Presence); p.Status != "away" || p.AwayMessage != "at lunch" || p.AwaySince.IsZero() {
+		t.Errorf("WHOIS bob = %+v", reply)
+	}
+	if !strings.Contains(reply.Message, ": at lunch") {
+		t.Errorf("WHOIS bob said %q", reply.Message)
+	}
+
+	// Senders of direct messages hear that bob is away, broadcasts don't tell
+	server.SendMessage("alice", "bob", "hi")
+	server.SendMessage("alice", "*", "hello all")
+	if got := bodies(drain(alice), "notice"); !slices.Equal(got, []string{"*** bob is away: at lunch"}) {
+		t.Errorf("alice was told %v", got)
+	}
+	if got := bodies(drain(bob), "message"); len(got) != 2 {
+		t.Errorf("bob got %v", got)
+	}
+
+	for _, tt := range []struct {
+		line   string
+		status int
+		state  string
+	}{
+		{"/BACK", StatusOK, "online"},
+		{"/BACK", StatusBadRequest, "online"},
+		{"/AWAY", StatusOK, "away"},
+	} {
+		if reply := server.commands.Dispatch(ctx, tt.line); reply.Status != tt.status {
+			t.Errorf("%s = %+v", tt.line, reply)
+		}
+		if users := server.ListUsers(); users[1].Nickname != "bob" || users[1].Status != tt.state {
+			t.Errorf("after %s users are %+v", tt.line, users)
+		}
+	}
+	if p, _ := server.Whois("bob"); p.AwayMessage != "Away" {
+		t.Errorf("a bare /AWAY left the message %q", p.AwayMessage)
+	}
+	if reply := server.commands.Dispatch(ctx, "/WHOIS carol"); reply.Status != StatusNotFound {
+		t.Errorf("WHOIS carol = %+v", reply)
+	}
+}
+
+// drainFiles returns the file events queued for a client
+func drainFiles(client *Client) []Event {
+	var events []Event
+	for len(client.fileCh) > 0 {
+		events = append(events, <-client.fileCh)
+	}
+	return events
+}
+
+func TestFileTransfer(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.MaxFileSize = 1024 })
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+
+	for _, tt := range []struct {
+		to, name string
+		size     int64
+	}{
+		{"bob", "../notes.txt", 10},
+		{"bob", "my notes.txt", 10},
+		{"bob", "notes.txt", 0},
+		{"bob", "notes.txt", 1025},
+		{"alice", "notes.txt", 10},
+		{"carol", "notes.txt", 10},
+	} {
+		if _, ok, _ := server.OfferFile("alice", tt.to, tt.name, tt.size); ok {
+			t.Errorf("OfferFile(%s, %s, %d) was accepted", tt.to, tt.name, tt.size)
+		}
+	}
+
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	id, ok, msg := server.OfferFile("alice", "bob", "notes.txt", int64(len(data)))
+	if !ok {
+		t.Fatalf("OfferFile: %s", msg)
+	}
+	if ok, _ := server.FileChunk("alice", id, data); ok {
+		t.Error("a chunk was relayed before bob accepted")
+	}
+	if ok, msg := server.AnswerFile("bob", id, true); !ok {
+		t.Fatalf("AnswerFile: %s", msg)
+	}
+	if got := drain(alice); len(got) != 1 || got[0].Type != "file-accepted" {
+		t.Errorf("alice got %+v", got)
+	}
+
+	// The chunks and the checksum reach bob on his file queue
+	server.FileChunk("alice", id, data[:6])
+	server.FileChunk("alice", id, data[6:])
+	if ok, msg := server.FinishFile("alice", id, hex.EncodeToString(sum[:])); !ok {
+		t.Fatalf("FinishFile: %s", msg)
+	}
+	var received []byte
+	files := drainFiles(bob)
+	for _, ev := range files[:len(files)-1] {
+		chunk, _ := base64.StdEncoding.DecodeString(ev.File.Data)
+		received = append(received, chunk...)
+	}
+	if done := files[len(files)-1]; !bytes.Equal(received, data) || done.Type != "file-done" || done.File.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("bob received %q then %+v", received, done)
+	}
+
+	// A checksum that doesn't match aborts the transfer for both users
+	id, _, _ = server.OfferFile("alice", "bob", "notes.txt", int64(len(data)))
+	server.AnswerFile("bob", id, true)
+	server.FileChunk("alice", id, data)
+	drain(alice)
+	drain(bob)
+	drainFiles(bob)
+	if ok, _ := server.FinishFile("alice", id, strings.Repeat("0", 64)); ok {
+		t.Error("a transfer with the wrong checksum finished")
+	}
+	for _, client := range []*Client{alice, bob} {
+		if got := bodies(drain(client), "file-aborted"); !slices.Equal(got, []string{"size or checksum mismatch"}) {
+			t.Errorf("abort notices %v", got)
+		}
+	}
+	if ok, _ := server.FinishFile("alice", id, hex.EncodeToString(sum[:])); ok {
+		t.Error("an aborted transfer finished")
+	}
+
+	// So does more data than was announced
+	id, _, _ = server.OfferFile("alice", "bob", "notes.txt", 4)
+	server.AnswerFile("bob", id, true)
+	if ok, msg := server.FileChunk("alice", id, data); ok || !strings.HasSuffix(msg, "more data than announced") {
+		t.Errorf("FileChunk = %v, %q", ok, msg)
+	}
+}
+
+func TestResumeRestoresTheSession(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.ResumeGrace = time.Minute })
+	alice := register(t, server, "alice")
+	register(t, server, "bob")
+	join(t, server, "#go", "alice", "bob")
+	token := alice.resumeToken
+
+	// While the connection is down the nickname is kept and messages wait
+	server.Detach("alice", alice)
+	if ok, _ := server.RegisterClient("alice", newTestClient(t, server)); ok {
+		t.Error("someone else took a held nickname")
+	}
+	if result := server.SendMessage("bob", "alice", "are you there?"); !slices.Equal(result.Queued, []string{"alice"}) {
+		t.Errorf("SendMessage = %+v", result)
+	}
+	if _, ok, _ := server.Resume("not the token", newTestClient(t, server)); ok {
+		t.Error("resumed with a wrong token")
+	}
+
+	again := newTestClient(t, server)
+	if nick, ok, msg := server.Resume(token, again); !ok || nick != "alice" {
+		t.Fatalf("Resume = %q, %v, %q", nick, ok, msg)
+	}
+	if got := members(server, "#go"); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Errorf("#go members = %v", got)
+	}
+	events := drain(again)
+	if got := bodies(events, "resume"); !slices.Equal(got, []string{token}) {
+		t.Errorf("resume tokens %v", got)
+	}
+	if got := bodies(events, "message"); !slices.Equal(got, []string{"are you there?"}) || !events[len(events)-1].Offline {
+		t.Errorf("held messages %+v", events)
+	}
+
+	// The token also takes the session from a connection that hasn't been noticed dead yet
+	third := newTestClient(t, server)
+	if _, ok, msg := server.Resume(token, third); !ok {
+		t.Fatalf("Resume over a live connection: %s", msg)
+	}
+	if _, err := again.conn.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("the old connection is still open")
+	}
+	if result := server.SendMessage("bob", "alice", "hi"); !slices.Equal(result.Success, []string{"alice"}) {
+		t.Errorf("SendMessage = %+v", result)
+	}
+	if got := bodies(drain(third), "message"); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("the new connection got %v", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	register(t, server, "bob")
+	join(t, server, "#go", "alice", "bob")
+	ctx := &CommandContext{Server: server, Client: alice, Nickname: "alice"}
+	server.commands.Dispatch(ctx, "/MSG bob hi")
+	server.commands.Dispatch(ctx, "/MSG #go,bob hello")
+	server.commands.Dispatch(ctx, "/NOPE")
+	for _, d := range []time.Duration{500 * time.Millisecond, time.Minute, 48 * time.Hour} {
+		server.metrics.observeConnection(d)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(server, w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	lines := strings.Split(w.Body.String(), "\n")
+	for _, want := range []string{
+		"# TYPE chat_nicknames gauge",
+		"chat_nicknames 2",
+		"chat_rooms 1",
+		"chat_messages_routed_total 3",
+		`chat_commands_total{command="MSG"} 2`,
+		`chat_commands_total{command="UNKNOWN"} 1`,
+		`chat_connection_duration_seconds_bucket{le="1"} 1`,
+		`chat_connection_duration_seconds_bucket{le="60"} 2`,
+		`chat_connection_duration_seconds_bucket{le="86400"} 2`,
+		`chat_connection_duration_seconds_bucket{le="+Inf"} 3`,
+		"chat_connection_duration_seconds_count 3",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("no %q in\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestClientsListing(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	alice.jsonMode.Store(true)
+	track(t, server, alice)
+	track(t, server, newTestClient(t, server))
+	if _, err := server.AddBot("echo", EchoBot{}); err != nil {
+		t.Fatal(err)
+	}
+	server.Op("alice", "test")
+
+	// Operators from the ops file are listed as such too
+	server.operators["bob"] = true
+	bob := register(t, server, "bob")
+	server.setAccount(bob, "bob")
+	track(t, server, bob)
+
+	w := httptest.NewRecorder()
+	handleClients(server, w, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	var clients []ClientInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil {
+		t.Fatalf("%v in %s", err, w.Body.String())
+	}
+	seen := make(map[string]ClientInfo)
+	for _, c := range clients {
+		seen[c.Nickname] = c
+	}
+	if len(clients) != 4 || len(seen) != 4 {
+		t.Fatalf("clients %+v, want alice, bob, echo and one without a nickname", clients)
+	}
+	if c := seen["bob"]; !c.Operator {
+		t.Errorf("bob = %+v", c)
+	}
+	if c := seen["alice"]; c.Protocol != "json" || !c.Operator || c.Bot {
+		t.Errorf("alice = %+v", c)
+	}
+	if c := seen["echo"]; !c.Bot || c.Protocol != "text" {
+		t.Errorf("echo = %+v", c)
+	}
+	if c := seen[""]; c.Operator || c.Bot {
+		t.Errorf("the connection without a nickname = %+v", c)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	server := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	register(t, server, "carol")
+	join(t, server, "#go", "alice", "bob")
+	drain(alice)
+
+	result := server.SendMessage("alice", "bob,carol", "lunch?")
+	if result.ID == "" {
+		t.Fatalf("SendMessage = %+v, want a message id", result)
+	}
+	received := drain(bob)
+	if len(received) != 1 || received[0].ID != result.ID {
+		t.Fatalf("bob got %+v", received)
+	}
+
+	// Writing the message to bob's connection tells alice it was delivered
+	server.acknowledge(received[0])
+	if got := drain(alice); len(got) != 1 || got[0].Type != "delivered" || got[0].ID != result.ID || got[0].From != "bob" {
+		t.Errorf("alice got %+v", got)
+	}
+	room := server.SendMessage("alice", "#go", "hello room")
+	for _, ev := range drain(bob) {
+		server.acknowledge(ev)
+	}
+	if got := drain(alice); len(got) != 0 {
+		t.Errorf("a room message was acknowledged: %+v", got)
+	}
+
+	// Each recipient's receipt reaches alice once
+	for _, tt := range []struct {
+		nick, target string
+		marked       int
+	}{
+		{"bob", result.ID, 1},
+		{"bob", result.ID, 0},
+		{"bob", room.ID, 0},
+		{"carol", "alice", 1},
+		{"carol", result.ID, 0},
+	} {
+		if n := server.MarkRead(tt.nick, tt.target); n != tt.marked {
+			t.Errorf("MarkRead(%s, %s) = %d, want %d", tt.nick, tt.target, n, tt.marked)
+		}
+	}
+	var readers []string
+	for _, ev := range drain(alice) {
+		if ev.Type == "read" && ev.ID == result.ID {
+			readers = append(readers, ev.From)
+		}
+	}
+	if !slices.Equal(readers, []string{"bob", "carol"}) {
+		t.Errorf("read receipts from %v", readers)
+	}
+
+	// Reading by sender marks every unread message from them
+	second := server.SendMessage("alice", "bob", "one")
+	third := server.SendMessage("alice", "bob", "two")
+	if second.ID == third.ID {
+		t.Errorf("two messages share the id %s", second.ID)
+	}
+	ctx := &CommandContext{Server: server, Client: bob, Nickname: "bob"}
+	if reply := server.commands.Dispatch(ctx, "/READ alice"); reply.Status != StatusOK {
+		t.Errorf("/READ alice = %+v", reply)
+	}
+	if reply := server.commands.Dispatch(ctx, "/READ alice"); reply.Status != StatusNotFound {
+		t.Errorf("/READ alice again = %+v", reply)
+	}
+}
+
+func TestReadMessagesAreForgotten(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	register(t, server, "carol")
+
+	// A message carol hasn't read yet keeps its place in line
+	server.SendMessage("alice", "carol", "later")
+	for i := 0; i < 100; i++ {
+		server.SendMessage("alice", "bob", "hi")
+		drain(bob)
+		server.MarkRead("bob", "alice")
+	}
+
+	server.receiptsMu.Lock()
+	defer server.receiptsMu.Unlock()
+	if len(server.receipts) != 1 || len(server.receiptOrder) > 2 {
+		t.Errorf("%d messages and %d ids kept after bob read them", len(server.receipts), len(server.receiptOrder))
+	}
+}
+
+func TestMessageFilters(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	op := register(t, server, "op")
+	server.Op("op", "test")
+
+	if ok, _ := server.AddFilter("hide", "x", "op"); ok {
+		t.Error("added a filter with an unknown action")
+	}
+	if ok, _ := server.AddFilter(FilterReject, "(", "op"); ok {
+		t.Error("added a filter with an invalid pattern")
+	}
+	for _, f := range []Filter{{Pattern: `(?i)buy now`, Action: FilterReject}, {Pattern: `darn`, Action: FilterRedact}, {Pattern: `secret`, Action: FilterFlag}} {
+		if ok, msg := server.AddFilter(f.Action, f.Pattern, "op"); !ok {
+			t.Fatalf("AddFilter(%s, %s): %s", f.Action, f.Pattern, msg)
+		}
+	}
+	drain(op)
+
+	if result := server.SendMessage("alice", "bob", "BUY NOW while it lasts"); result.Rejected == "" || !slices.Equal(result.Failed, []string{"bob"}) {
+		t.Errorf("a rejected message was sent: %+v", result)
+	}
+	server.SendMessage("alice", "bob", "darn it, darn")
+	server.SendMessage("alice", "bob", "the secret plan")
+	if got := bodies(drain(bob), "message"); !slices.Equal(got, []string{"**** it, ****", "the secret plan"}) {
+		t.Errorf("bob got %v", got)
+	}
+	if got := bodies(drain(op), "notice"); !slices.Equal(got, []string{"*** Flagged message from alice to bob: the secret plan"}) {
+		t.Errorf("the operator was told %v", got)
+	}
+
+	// The filters outlive a restart, minus the one removed
+	if ok, _ := server.RemoveFilter("darn", "op"); !ok {
+		t.Error("RemoveFilter(darn) failed")
+	}
+	if ok, _ := server.RemoveFilter("darn", "op"); ok {
+		t.Error("removed a filter twice")
+	}
+	reloaded, err := NewFilterList(filepath.Join(server.config.DataDir, "filters.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patterns []string
+	for _, f := range reloaded.List() {
+		patterns = append(patterns, string(f.Action)+" "+f.Pattern+" by "+f.By)
+	}
+	if want := []string{"reject (?i)buy now by op", "flag secret by op"}; !slices.Equal(patterns, want) {
+		t.Errorf("reloaded filters %q, want %q", patterns, want)
+	}
+	if _, rejected, _ := reloaded.Apply("buy now"); !rejected {
+		t.Error("a reloaded filter doesn't match")
+	}
+}
+
+func TestIgnoreLists(t *testing.T) {
+	server := newTestServer(t, func(c *Config) { c.IgnoreMode = IgnoreFail })
+	if err := server.accounts.Register("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	server.setAccount(alice, "alice")
+	register(t, server, "mallory")
+
+	for _, tt := range []struct {
+		target string
+		ignore bool
+		ok     bool
+	}{
+		{"mallory", true, true},
+		{"mallory", true, false},
+		{"alice", true, false},
+		{"not a nick", true, false},
+		{"bob", false, false},
+		{"bob", true, true},
+	} {
+		if ok, msg := server.Ignore(alice, tt.target, tt.ignore); ok != tt.ok {
+			t.Errorf("Ignore(%q, %v) = %v, %q", tt.target, tt.ignore, ok, msg)
+		}
+	}
+
+	// The fail mode tells mallory the message didn't get through
+	if result := server.SendMessage("mallory", "alice", "hey"); !slices.Equal(result.Failed, []string{"alice"}) {
+		t.Errorf("SendMessage = %+v", result)
+	}
+	if got := drain(alice); len(got) != 0 {
+		t.Errorf("alice got %+v", got)
+	}
+
+	// The list is saved with the account and merged into the next session's
+	server.UnregisterClient("alice")
+	again := register(t, server, "alice")
+	server.Ignore(again, "eve", true)
+	server.setAccount(again, "alice")
+	server.restoreIgnores(again)
+	if got := server.Ignores(again); !slices.Equal(got, []string{"bob", "eve", "mallory"}) {
+		t.Errorf("ignoring %v after identifying", got)
+	}
+	if got := server.accounts.Ignores("alice"); !slices.Equal(got, []string{"bob", "eve", "mallory"}) {
+		t.Errorf("the account keeps %v", got)
+	}
+}
+
+func TestMentionsAndHighlights(t *testing.T) {
+	server := newTestServer(t)
+	register(t, server, "alice")
+	bob := register(t, server, "bob")
+	register(t, server, "carol")
+	server.UnregisterClient("carol")
+	join(t, server, "#go", "alice", "bob")
+	drain(bob)
+
+	for _, tt := range []struct {
+		keyword string
+		add, ok bool
+	}{
+		{"Deploy", true, true},
+		{"deploy", true, false},
+		{"two words", true, false},
+		{"outage", true, true},
+		{"outage", false, true},
+		{"outage", false, false},
+	} {
+		if ok, msg := server.Highlight(bob, tt.keyword, tt.add); ok != tt.ok {
+			t.Errorf("Highlight(%q, %v) = %v, %q", tt.keyword, tt.add, ok, msg)
+		}
+	}
+
+	// Mentions and keywords tag the message, text clients see it marked
+	server.SendMessage("alice", "#go", "@bob the DEPLOY is done, @bobby")
+	server.SendMessage("alice", "#go", "deployment tomorrow")
+	events := drain(bob)
+	if len(events) != 2 || !slices.Equal(events[0].Tags, []string{"@bob", "deploy"}) || events[1].Tags != nil {
+		t.Fatalf("bob got %+v", events)
+	}
+	if got := events[0].text(); got != "! [#go] alice: @bob the DEPLOY is done, @bobby" {
+		t.Errorf("text = %q", got)
+	}
+
+	// Someone offline gets a digest of the mentions when they come back
+	server.SendMessage("alice", "#go", "@carol see the channel")
+	server.SendMessage("alice", "*", "thanks @carol and @carol")
+	carol := newTestClient(t, server)
+	if ok, msg := server.RegisterClient("carol", carol); !ok {
+		t.Fatal(msg)
+	}
+	digest := bodies(drain(carol), "notice")
+	if len(digest) != 3 || digest[0] != "*** You were mentioned 2 time(s) while offline:" ||
+		!strings.HasSuffix(digest[1], "alice in #go: @carol see the channel") ||
+		!strings.HasSuffix(digest[2], "alice to everyone: thanks @carol and @carol") {
+		t.Errorf("carol's digest %q", digest)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// mentionPattern finds @nickname mentions in a message
+var mentionPattern = regexp.MustCompile(`@([a-zA-Z][a-zA-Z0-9_]{0,11})\b`)
+
+// mentionsOf returns the nicknames a message mentions
+func mentionsOf(message string) []string {
+	var nicks []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(message, -1) {
+		if !slices.Contains(nicks, m[1]) {
+			nicks = append(nicks, m[1])
+		}
+	}
+	return nicks
+}
+
+// wordsOf returns the words of a message in lower case, for matching keywords
+func wordsOf(message string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(message), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		words[word] = true
+	}
+	return words
+}
+
+// highlights lists what in a message should catch a recipient's eye, a
+// mention of their nickname and any of their keywords
+func highlights(nickname string, keywords, mentioned []string, words map[string]bool) []string {
+	var tags []string
+	if slices.Contains(mentioned, nickname) {
+		tags = append(tags, "@"+nickname)
+	}
+	for _, keyword := range keywords {
+		if words[keyword] {
+			tags = append(tags, keyword)
+		}
+	}
+	return tags
+}
+
+// mentionedOffline returns the offline users a room message or broadcast
+// mentions who don't ignore its sender, the caller must hold s.mu
+func (s *Server) mentionedOffline(sender string, mentioned []string) []string {
+	var offline []string
+	for _, nick := range mentioned {
+		_, online := s.clients[nick]
+		_, remote := s.remote[nick]
+		if nick == sender || online || remote {
+			continue
+		}
+		if held, exists := s.held[nick]; exists && held.ignores[sender] {
+			continue
+		}
+		if slices.Contains(s.accounts.Ignores(nick), sender) {
+			continue
+		}
+		offline = append(offline, nick)
+	}
+	return offline
+}
+
+// catchUp hands an online user the messages waiting in their mailbox. The
+// mailbox is written without s.mu, so a user may register between being
+// found offline and a message for them being queued.
+func (s *Server) catchUp(nickname string) {
+	s.mu.RLock()
+	client, online := s.clients[nickname]
+	s.mu.RUnlock()
+	if online {
+		s.deliverOffline(nickname, client)
+	}
+}
+
+// deliverMentions sends a nickname's new client a digest of the room
+// messages and broadcasts that mentioned it while it was offline
+func (s *Server) deliverMentions(nickname string, client *Client) {
+	mentions, err := s.mailbox.TakeMentions(nickname)
+	if err != nil {
+		s.logger.Printf("Failed to save the mailbox: %v", err)
+	}
+	if len(mentions) == 0 {
+		return
+	}
+
+	digest := []Event{{Type: "notice", Body: fmt.Sprintf("*** You were mentioned %d time(s) while offline:", len(mentions)), Time: time.Now()}}
+	for _, m := range mentions {
+		where := "in " + m.To
+		if m.To == "*" {
+			where = "to everyone"
+		}
+		body := fmt.Sprintf("***   [%s] %s %s: %s", m.Time.Format(time.DateTime), m.From, where, m.Body)
+		digest = append(digest, Event{Type: "notice", From: m.From, Body: body, Time: m.Time})
+	}
+	for _, ev := range digest {
+		if sent, _ := client.offer(ev, 5*time.Second); !sent {
+			s.logger.Printf("Gave up on the digest of mentions for %s, the client isn't reading", nickname)
+			return
+		}
+	}
+	s.logger.Printf("Delivered a digest of %d mention(s) to %s", len(mentions), nickname)
+}
+
+// maxHighlights limits how many keywords a user may highlight
+const maxHighlights = 20
+
+// Highlight adds a keyword that highlights messages for a user, or removes it
+func (s *Server) Highlight(client *Client, keyword string, add bool) (bool, string) {
+	keyword = strings.ToLower(keyword)
+	valid, _ := regexp.MatchString(`^[\pL\pN_]{1,32}$`, keyword)
+	if !valid {
+		return false, "Invalid keyword. Keywords are single words of up to 32 letters, digits or underscores"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exists := slices.Contains(client.highlights, keyword)
+	switch {
+	case add && exists:
+		return false, fmt.Sprintf("You are already highlighting %s", keyword)
+	case add && len(client.highlights) >= maxHighlights:
+		return false, fmt.Sprintf("You can highlight at most %d keywords", maxHighlights)
+	case add:
+		client.highlights = append(client.highlights, keyword)
+		return true, fmt.Sprintf("Highlighting messages with %s", keyword)
+	case !exists:
+		return false, fmt.Sprintf("You are not highlighting %s", keyword)
+	default:
+		client.highlights = slices.DeleteFunc(slices.Clone(client.highlights), func(k string) bool { return k == keyword })
+		return true, fmt.Sprintf("No longer highlighting %s", keyword)
+	}
+}
+
+// Highlights returns a user's highlight keywords
+func (s *Server) Highlights(client *Client) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(client.highlights)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connectionBuckets are the upper bounds, in seconds, of the buckets
+// connection durations are counted in
+var connectionBuckets = []float64{1, 10, 60, 300, 1800, 3600, 6 * 3600, 24 * 3600}
+
+// Metrics counts what the server does, for the admin endpoint
+type Metrics struct {
+	connections atomic.Int64 // Connections accepted
+	routed      atomic.Int64 // Messages sent, once per recipient user, room or server
+	dropped     atomic.Int64 // Messages dropped because a client's outCh was full
+
+	mu        sync.Mutex       // mutex to protect commands and the duration histogram
+	commands  map[string]int64 // Commands handled by name, UNKNOWN for anything unrecognized
+	durations []int64          // Closed connections per bucket of connectionBuckets, the last for longer ones
+	durSum    float64          // Total seconds of closed connections
+	durCount  int64            // Closed connections
+}
+
+// NewMetrics creates zeroed metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		commands:  make(map[string]int64),
+		durations: make([]int64, len(connectionBuckets)+1),
+	}
+}
+
+// countCommand counts one command
+func (m *Metrics) countCommand(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands[name]++
+}
+
+// observeConnection records how long a closed connection was open
+func (m *Metrics) observeConnection(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seconds := d.Seconds()
+	i, _ := slices.BinarySearch(connectionBuckets, seconds)
+	m.durations[i]++
+	m.durSum += seconds
+	m.durCount++
+}
+
+// writeMetric writes one metric with its HELP and TYPE lines
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// WriteMetrics writes the server's metrics in the Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) {
+	s.mu.RLock()
+	conns, users, remote, rooms, held := len(s.conns), len(s.clients), len(s.remote), len(s.rooms), len(s.held)
+	s.mu.RUnlock()
+	accounts := s.accounts.Count()
+
+	writeMetric(w, "chat_connected_clients", "gauge", "Open client connections.", conns)
+	writeMetric(w, "chat_nicknames", "gauge", "Nicknames in use on this server, bots included.", users)
+	writeMetric(w, "chat_remote_nicknames", "gauge", "Nicknames in use on linked servers.", remote)
+	writeMetric(w, "chat_held_nicknames", "gauge", "Nicknames held for users who may resume.", held)
+	writeMetric(w, "chat_registered_nicknames", "gauge", "Nicknames registered with a password.", accounts)
+	writeMetric(w, "chat_rooms", "gauge", "Open rooms.", rooms)
+	writeMetric(w, "chat_connections_total", "counter", "Connections accepted.", s.metrics.connections.Load())
+	writeMetric(w, "chat_messages_routed_total", "counter", "Messages sent, once per recipient user, room or server.", s.metrics.routed.Load())
+	writeMetric(w, "chat_messages_dropped_total", "counter", "Messages dropped because a client was too slow.", s.metrics.dropped.Load())
+
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP chat_commands_total Commands handled, by command.\n# TYPE chat_commands_total counter\n")
+	names := make([]string, 0, len(m.commands))
+	for name := range m.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "chat_commands_total{command=%q} %d\n", name, m.commands[name])
+	}
+
+	fmt.Fprintf(w, "# HELP chat_connection_duration_seconds How long closed connections were open.\n# TYPE chat_connection_duration_seconds histogram\n")
+	var cumulative int64
+	for i, le := range connectionBuckets {
+		cumulative += m.durations[i]
+		fmt.Fprintf(w, "chat_connection_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(w, "chat_connection_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durCount)
+	fmt.Fprintf(w, "chat_connection_duration_seconds_sum %g\n", m.durSum)
+	fmt.Fprintf(w, "chat_connection_duration_seconds_count %d\n", m.durCount)
+}
+
+// ClientInfo describes one connection for the admin /clients listing
+type ClientInfo struct {
+	Presence
+	Protocol string      `json:"protocol"` // "text" or "json"
+	Operator bool        `json:"operator"`
+	Bot      bool        `json:"bot,omitempty"`
+	Stats    ClientStats `json:"stats"`
+}
+
+// Clients lists every connection, with or without a nickname, and every bot
+func (s *Server) Clients() []ClientInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(s.conns)+len(s.bots))
+	add := func(client *Client) {
+		info := ClientInfo{
+			Presence: presence(client.nickname, client),
+			Protocol: "text",
+			Operator: s.IsOperator(client),
+			Bot:      client.bot != nil,
+			Stats:    clientStats(client),
+		}
+		if client.jsonMode.Load() {
+			info.Protocol = "json"
+		}
+		clients = append(clients, info)
+	}
+	for client := range s.conns {
+		add(client)
+	}
+	for _, bot := range s.bots {
+		add(bot.client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Connected.Before(clients[j].Connected)
+	})
+	return clients
+}
+
+// handleMetrics serves the server's metrics for Prometheus to scrape
+func handleMetrics(server *Server, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	server.WriteMetrics(w)
+}
+
+// handleClients serves the connected clients as JSON for the ops dashboard
+func handleClients(server *Server, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(server.Clients())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban keeps a nickname or an IP address off the server
+type Ban struct {
+	Mask   string    `json:"mask"`           // Nickname or IP address
+	Until  time.Time `json:"until,omitzero"` // When the ban expires, zero for never
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"` // Operator who set the ban
+}
+
+// BanList keeps the active bans, persisted so they survive restarts
+type BanList struct {
+	mu   sync.Mutex     // mutex to protect bans
+	path string         // File the bans are persisted to
+	bans map[string]Ban // map of masks to bans
+}
+
+// NewBanList creates a ban list, loading any bans previously saved at path
+func NewBanList(path string) (*BanList, error) {
+	b := &BanList{path: path, bans: make(map[string]Ban)}
+	if err := readJSONFile(path, &b.bans); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Add bans a nickname or IP address, replacing any earlier ban of it
+func (b *BanList) Add(ban Ban) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans[ban.Mask] = ban
+	return writeJSONFile(b.path, b.bans)
+}
+
+// Remove lifts the ban of a nickname or IP address
+func (b *BanList) Remove(mask string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.bans[mask]; !exists {
+		return false
+	}
+	delete(b.bans, mask)
+	writeJSONFile(b.path, b.bans)
+	return true
+}
+
+// Check returns the ban on a nickname or IP address, if there is one in force
+func (b *BanList) Check(mask string) (Ban, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, exists := b.bans[mask]
+	if !exists {
+		return Ban{}, false
+	}
+	if !ban.Until.IsZero() && time.Now().After(ban.Until) {
+		// Expired, forget it
+		delete(b.bans, mask)
+		writeJSONFile(b.path, b.bans)
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// describe explains a ban to the banned user
+func (ban Ban) describe() string {
+	text := fmt.Sprintf("%s is banned", ban.Mask)
+	if !ban.Until.IsZero() {
+		text += fmt.Sprintf(" until %s", ban.Until.Format(time.DateTime))
+	}
+	if ban.Reason != "" {
+		text += ": " + ban.Reason
+	}
+	return text
+}
+
+// loadOperators reads the accounts allowed to moderate, one per line,
+// blank lines and lines starting with # are ignored
+func loadOperators(path string) (map[string]bool, error) {
+	ops := make(map[string]bool)
+	if path == "" {
+		return ops, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ops[line] = true
+		}
+	}
+	return ops, nil
+}
+
+// IsOperator reports whether a client may use the moderation commands
+func (s *Server) IsOperator(client *Client) bool {
+	return client.operator.Load() || (client.account != "" && s.operators[client.account])
+}
+
+// Op grants operator status to a connected user for the rest of their session
+func (s *Server) Op(nickname, by string) (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, exists := s.clients[nickname]
+	if !exists {
+		return false, fmt.Sprintf("No such user: %s", nickname)
+	}
+	client.operator.Store(true)
+	s.deliver(nickname, client, Event{Type: "notice", Body: fmt.Sprintf("*** %s made you an operator", by), Time: time.Now()})
+	s.logger.Printf("Operator %s granted operator status to %s", by, nickname)
+	return true, fmt.Sprintf("%s is now an operator", nickname)
+}
+
+// Kick disconnects a user, telling them who kicked them and why
+func (s *Server) Kick(nickname, by, reason string) (bool, string) {
+	s.mu.RLock()
+	client, exists := s.clients[nickname]
+	s.mu.RUnlock()
+	if !exists {
+		return false, fmt.Sprintf("No such user: %s", nickname)
+	}
+
+	s.disconnect(client, fmt.Sprintf("*** You were kicked by %s: %s", by, reason))
+	s.logger.Printf("Operator %s kicked %s: %s", by, nickname, reason)
+	return true, fmt.Sprintf("Kicked %s", nickname)
+}
+
+// Ban bans a nickname or IP address and disconnects the users it matches
+func (s *Server) Ban(mask, by string, duration time.Duration, reason string) (bool, string) {
+	ban := Ban{Mask: mask, Reason: reason, By: by}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration)
+	}
+	if err := s.bans.Add(ban); err != nil {
+		s.logger.Printf("Failed to save bans: %v", err)
+		return false, "Failed to save the ban"
+	}
+	s.logger.Printf("Operator %s banned %s: %s", by, mask, ban.describe())
+
+	// Drop everyone the ban applies to, matching IP bans against the remote
+	// address, and a session held for the nickname so it can't be resumed
+	s.mu.RLock()
+	var matched []*Client
+	for client := range s.conns {
+		host, _, _ := net.SplitHostPort(client.conn.RemoteAddr().String())
+		if client.nickname == mask || host == mask {
+			matched = append(matched, client)
+		}
+	}
+	held := s.held[mask]
+	s.mu.RUnlock()
+	for _, client := range matched {
+		s.disconnect(client, fmt.Sprintf("*** You were banned by %s: %s", by, ban.describe()))
+	}
+	if held != nil {
+		if moved, released := s.releaseHeld(mask, held); released {
+			s.logger.Printf("Released the held session of %s, %d message(s) moved to the mailbox", mask, moved)
+		}
+	}
+
+	return true, fmt.Sprintf("Banned %s, %d connection(s) dropped", mask, len(matched))
+}
+
+// Unban lifts the ban on a nickname or IP address
+func (s *Server) Unban(mask, by string) (bool, string) {
+	if !s.bans.Remove(mask) {
+		return false, fmt.Sprintf("%s is not banned", mask)
+	}
+	s.logger.Printf("Operator %s unbanned %s", by, mask)
+	return true, fmt.Sprintf("Unbanned %s", mask)
+}
+
+// Mute stops a user from sending messages, for good when duration is 0
+func (s *Server) Mute(nickname, by string, duration time.Duration) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Mutes follow a connected user, see ChangeNickname
+	client, exists := s.clients[nickname]
+	if !exists {
+		return false, fmt.Sprintf("No such user: %s", nickname)
+	}
+
+	var until time.Time
+	notice := fmt.Sprintf("*** You were muted by %s", by)
+	if duration > 0 {
+		until = time.Now().Add(duration)
+		notice += fmt.Sprintf(" for %v", duration)
+	}
+	s.mutes[nickname] = until
+	s.deliver(nickname, client, Event{Type: "notice", Body: notice, Time: time.Now()})
+	s.logger.Printf("Operator %s muted %s", by, nickname)
+	return true, fmt.Sprintf("Muted %s", nickname)
+}
+
+// Unmute lets a muted user send messages again
+func (s *Server) Unmute(nickname, by string) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, muted := s.mutes[nickname]; !muted {
+		return false, fmt.Sprintf("%s is not muted", nickname)
+	}
+	delete(s.mutes, nickname)
+	if client, exists := s.clients[nickname]; exists {
+		s.deliver(nickname, client, Event{Type: "notice", Body: fmt.Sprintf("*** You were unmuted by %s", by), Time: time.Now()})
+	}
+	s.logger.Printf("Operator %s unmuted %s", by, nickname)
+	return true, fmt.Sprintf("Unmuted %s", nickname)
+}
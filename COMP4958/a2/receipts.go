@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// receipt is a direct message whose recipients may still report reading it
+type receipt struct {
+	from   string          // Sender, who receives the read receipts
+	unread map[string]bool // Recipients who haven't sent a read receipt yet
+	sent   time.Time       // When the message was sent
+}
+
+// newMessageID numbers a routed message. The start time keeps ids in the
+// mailbox from colliding with ids handed out after a restart.
+func (s *Server) newMessageID() string {
+	return fmt.Sprintf("%x-%d", s.started.Unix(), s.nextMessageID.Add(1))
+}
+
+// trackMessage remembers a direct message for /READ. Messages are
+// forgotten once every recipient has read them, or when the mailbox would
+// have dropped them.
+func (s *Server) trackMessage(id, from string, recipients []string) {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+
+	s.expireReceipts()
+	r := &receipt{from: from, unread: make(map[string]bool), sent: time.Now()}
+	for _, nick := range recipients {
+		r.unread[nick] = true
+	}
+	s.receipts[id] = r
+	s.receiptOrder = append(s.receiptOrder, id)
+}
+
+// expireReceipts drops messages older than the mailbox TTL, the caller
+// must hold s.receiptsMu
+func (s *Server) expireReceipts() {
+	cutoff := time.Now().Add(-s.config.MailboxTTL)
+	for len(s.receiptOrder) > 0 {
+		r, exists := s.receipts[s.receiptOrder[0]]
+		if exists && r.sent.After(cutoff) {
+			break
+		}
+		delete(s.receipts, s.receiptOrder[0])
+		s.receiptOrder = s.receiptOrder[1:]
+	}
+}
+
+// compactReceipts drops the ids of messages everyone has read from
+// receiptOrder once they make up most of it, the caller must hold
+// s.receiptsMu
+func (s *Server) compactReceipts() {
+	if len(s.receiptOrder) <= 2*len(s.receipts) {
+		return
+	}
+	s.receiptOrder = slices.DeleteFunc(s.receiptOrder, func(id string) bool {
+		_, exists := s.receipts[id]
+		return !exists
+	})
+}
+
+// acknowledge tells the sender of a direct message that it reached its
+// recipient, called once the message was written to the recipient's
+// connection or handed to a bot. Room messages and broadcasts aren't
+// acknowledged, they would flood their sender with acknowledgements.
+func (s *Server) acknowledge(ev Event) {
+	if ev.Type != "message" || ev.ID == "" || ev.To == "*" || strings.HasPrefix(ev.To, "#") {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sender, online := s.clients[ev.From]; online {
+		s.deliver(ev.From, sender, Event{Type: "delivered", ID: ev.ID, From: ev.To, To: ev.From, Time: time.Now()})
+	}
+}
+
+// MarkRead sends read receipts to the senders of direct messages a user
+// has read, given a message id, or a sender's nickname for every message
+// from that sender. It returns how many messages were marked.
+func (s *Server) MarkRead(nickname, target string) int {
+	s.receiptsMu.Lock()
+	s.expireReceipts()
+	var receipts []Event
+	mark := func(id string, r *receipt) {
+		delete(r.unread, nickname)
+		if len(r.unread) == 0 {
+			delete(s.receipts, id)
+		}
+		receipts = append(receipts, Event{Type: "read", ID: id, From: nickname, To: r.from, Time: time.Now()})
+	}
+	if r, exists := s.receipts[target]; exists && r.unread[nickname] {
+		mark(target, r)
+	} else {
+		for _, id := range s.receiptOrder {
+			if r, exists := s.receipts[id]; exists && r.from == target && r.unread[nickname] {
+				mark(id, r)
+			}
+		}
+	}
+	s.compactReceipts()
+	s.receiptsMu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ev := range receipts {
+		if sender, online := s.clients[ev.To]; online {
+			s.deliver(ev.To, sender, ev)
+		}
+	}
+	return len(receipts)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Room is a named channel that clients can join
+type Room struct {
+	name    string             // Room name, including the leading '#'
+	topic   string             // Room topic, empty if not set
+	members map[string]*Client // map of member nicknames to clients
+}
+
+// JoinRoom adds a client to a room, creating the room if it doesn't exist
+func (s *Server) JoinRoom(nickname, name string) (bool, string) {
+	// Validate room name format: a '#' followed by letters, numbers, underscores or dashes
+	valid, _ := regexp.MatchString(`^#[a-zA-Z0-9_-]{1,20}$`, name)
+	if !valid {
+		return false, "Invalid room name. Room names look like #room"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, exists := s.clients[nickname]
+	if !exists {
+		return false, "Cannot join room: nickname not found"
+	}
+
+	room, exists := s.rooms[name]
+	if !exists {
+		room = &Room{name: name, members: make(map[string]*Client)}
+		s.rooms[name] = room
+		s.logger.Printf("Room %s created by %s", name, nickname)
+	}
+	if _, member := room.members[nickname]; member {
+		return false, fmt.Sprintf("You are already in %s", name)
+	}
+
+	room.members[nickname] = client
+	s.notifyRoom(room, nickname, fmt.Sprintf("*** %s joined %s", nickname, name))
+	s.notifyBots("join", nickname, room)
+	s.logger.Printf("User %s joined %s", nickname, name)
+
+	if room.topic != "" {
+		return true, fmt.Sprintf("Joined %s. Topic: %s", name, room.topic)
+	}
+	return true, fmt.Sprintf("Joined %s", name)
+}
+
+// PartRoom removes a client from a room, deleting the room once it is empty
+func (s *Server) PartRoom(nickname, name string) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, exists := s.rooms[name]
+	if !exists {
+		return false, fmt.Sprintf("No such room: %s", name)
+	}
+	if _, member := room.members[nickname]; !member {
+		return false, fmt.Sprintf("You are not in %s", name)
+	}
+
+	delete(room.members, nickname)
+	s.logger.Printf("User %s left %s", nickname, name)
+	if len(room.members) == 0 {
+		delete(s.rooms, name)
+		s.logger.Printf("Room %s closed", name)
+	} else {
+		s.notifyRoom(room, "", fmt.Sprintf("*** %s left %s", nickname, name))
+		s.notifyBots("leave", nickname, room)
+	}
+	return true, fmt.Sprintf("Left %s", name)
+}
+
+// SetTopic changes the topic of a room, only members may change it
+func (s *Server) SetTopic(nickname, name, topic string) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, exists := s.rooms[name]
+	if !exists {
+		return false, fmt.Sprintf("No such room: %s", name)
+	}
+	if _, member := room.members[nickname]; !member {
+		return false, fmt.Sprintf("You must join %s before changing its topic", name)
+	}
+
+	room.topic = topic
+	s.notifyRoom(room, nickname, fmt.Sprintf("*** %s set the topic of %s to: %s", nickname, name, topic))
+	s.logger.Printf("User %s set topic of %s", nickname, name)
+	return true, fmt.Sprintf("Topic of %s set to: %s", name, topic)
+}
+
+// RoomInfo returns the topic and the sorted member list of a room
+func (s *Server) RoomInfo(name string) (string, []string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, exists := s.rooms[name]
+	if !exists {
+		return "", nil, false
+	}
+
+	members := make([]string, 0, len(room.members))
+	for nick := range room.members {
+		members = append(members, nick)
+	}
+	sort.Strings(members)
+	return room.topic, members, true
+}
+
+// notifyRoom sends a notice to every member of a room except one,
+// the caller must hold s.mu
+func (s *Server) notifyRoom(room *Room, except, notice string) {
+	for nick, client := range room.members {
+		if nick == except {
+			continue
+		}
+		s.deliver(nick, client, Event{Type: "notice", To: room.name, Body: notice, Time: time.Now()})
+	}
+}
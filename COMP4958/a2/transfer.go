@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileStallTimeout is how long a transfer waits for room in the recipient's
+// file queue before it is aborted
+const fileStallTimeout = 30 * time.Second
+
+// Transfer is a file being sent from one user to another. The data is
+// relayed chunk by chunk and never stored on the server.
+type Transfer struct {
+	ID       string
+	From     string    // Sender nickname
+	To       string    // Recipient nickname
+	Name     string    // File name, without any directories
+	Size     int64     // Size the sender announced, in bytes
+	accepted bool      // The recipient accepted the offer
+	received int64     // Bytes relayed so far
+	hash     hash.Hash // SHA-256 of the bytes relayed so far
+}
+
+// info describes the transfer for its events
+func (t *Transfer) info() *FileInfo {
+	return &FileInfo{ID: t.ID, Name: t.Name, Size: t.Size}
+}
+
+// OfferFile offers a file to another user, returning the transfer id
+func (s *Server) OfferFile(from, to, name string, size int64) (string, bool, string) {
+	if name != filepath.Base(name) || strings.ContainsAny(name, " \t") || name == "." || name == ".." {
+		return "", false, "Invalid file name, send a name without directories or spaces"
+	}
+	if size <= 0 || size > s.config.MaxFileSize {
+		return "", false, fmt.Sprintf("File size must be between 1 and %d bytes", s.config.MaxFileSize)
+	}
+	if to == from {
+		return "", false, "You can't send a file to yourself"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, exists := s.clients[to]
+	if !exists {
+		if _, remote := s.remote[to]; remote {
+			return "", false, fmt.Sprintf("%s is on another server, files can only be sent within a server", to)
+		}
+		return "", false, fmt.Sprintf("No such user: %s", to)
+	}
+
+	t := &Transfer{ID: strconv.FormatUint(s.nextTransferID.Add(1), 10), From: from, To: to, Name: name, Size: size, hash: sha256.New()}
+	s.transfersMu.Lock()
+	s.transfers[t.ID] = t
+	s.transfersMu.Unlock()
+
+	s.deliver(to, client, Event{Type: "file-offer", From: from, To: to, File: t.info(), Time: time.Now()})
+	s.logger.Printf("Transfer %s: %s offered %s (%d bytes) to %s", t.ID, from, name, size, to)
+	return t.ID, true, fmt.Sprintf("Transfer %s: offered %s to %s, waiting for them to accept", t.ID, name, to)
+}
+
+// AnswerFile accepts or rejects a file offered to a user, telling the sender
+func (s *Server) AnswerFile(nickname, id string, accept bool) (bool, string) {
+	s.transfersMu.Lock()
+	t, exists := s.transfers[id]
+	if !exists || t.To != nickname || t.accepted {
+		s.transfersMu.Unlock()
+		return false, fmt.Sprintf("No file offer %s waiting for you", id)
+	}
+	evType := "file-accepted"
+	if accept {
+		t.accepted = true
+	} else {
+		evType = "file-rejected"
+		delete(s.transfers, id)
+	}
+	s.transfersMu.Unlock()
+
+	s.mu.RLock()
+	if sender, online := s.clients[t.From]; online {
+		s.deliver(t.From, sender, Event{Type: evType, From: nickname, To: t.From, File: t.info(), Time: time.Now()})
+	}
+	s.mu.RUnlock()
+
+	if !accept {
+		s.logger.Printf("Transfer %s: rejected by %s", id, nickname)
+		return true, fmt.Sprintf("Rejected %s from %s", t.Name, t.From)
+	}
+	s.logger.Printf("Transfer %s: accepted by %s", id, nickname)
+	return true, fmt.Sprintf("Accepted %s from %s, receiving %d bytes", t.Name, t.From, t.Size)
+}
+
+// FileChunk relays the next piece of an accepted transfer to its recipient.
+// Chunks travel on the recipient's file queue, so they never hold up chat
+// messages, and a sender that outpaces the recipient waits here.
+func (s *Server) FileChunk(nickname, id string, data []byte) (bool, string) {
+	s.transfersMu.Lock()
+	t, exists := s.transfers[id]
+	if !exists || t.From != nickname || !t.accepted {
+		s.transfersMu.Unlock()
+		return false, fmt.Sprintf("No accepted transfer %s from you", id)
+	}
+	if t.received+int64(len(data)) > t.Size {
+		s.transfersMu.Unlock()
+		s.abortTransfer(t, "more data than announced")
+		return false, fmt.Sprintf("Transfer %s aborted: more data than announced", id)
+	}
+	t.received += int64(len(data))
+	t.hash.Write(data)
+	s.transfersMu.Unlock()
+
+	s.mu.RLock()
+	recipient, online := s.clients[t.To]
+	s.mu.RUnlock()
+	if !online {
+		s.abortTransfer(t, "recipient left")
+		return false, fmt.Sprintf("Transfer %s aborted: %s left", id, t.To)
+	}
+
+	info := t.info()
+	info.Data = base64.StdEncoding.EncodeToString(data)
+	timer := time.NewTimer(fileStallTimeout)
+	defer timer.Stop()
+	select {
+	case recipient.fileCh <- Event{Type: "file-data", From: t.From, To: t.To, File: info, Time: time.Now()}:
+		return true, ""
+	case <-recipient.done:
+	case <-timer.C:
+	}
+	s.abortTransfer(t, "recipient stopped reading")
+	return false, fmt.Sprintf("Transfer %s aborted: %s stopped reading", id, t.To)
+}
+
+// FinishFile completes a transfer once the sender's checksum matches what was relayed
+func (s *Server) FinishFile(nickname, id, checksum string) (bool, string) {
+	s.transfersMu.Lock()
+	t, exists := s.transfers[id]
+	if !exists || t.From != nickname || !t.accepted {
+		s.transfersMu.Unlock()
+		return false, fmt.Sprintf("No accepted transfer %s from you", id)
+	}
+	sum := hex.EncodeToString(t.hash.Sum(nil))
+	complete := t.received == t.Size && strings.EqualFold(checksum, sum)
+	s.transfersMu.Unlock()
+
+	if !complete {
+		s.abortTransfer(t, "size or checksum mismatch")
+		return false, fmt.Sprintf("Transfer %s aborted: received %d of %d bytes with checksum %s", id, t.received, t.Size, sum)
+	}
+
+	s.transfersMu.Lock()
+	delete(s.transfers, id)
+	s.transfersMu.Unlock()
+
+	// The end goes through the file queue too, so it arrives after the last chunk
+	s.mu.RLock()
+	recipient, online := s.clients[t.To]
+	s.mu.RUnlock()
+	if online {
+		info := t.info()
+		info.SHA256 = sum
+		select {
+		case recipient.fileCh <- Event{Type: "file-done", From: t.From, To: t.To, File: info, Time: time.Now()}:
+		case <-recipient.done:
+		case <-time.After(fileStallTimeout):
+		}
+	}
+	s.logger.Printf("Transfer %s: %s sent %s (%d bytes) to %s", id, t.From, t.Name, t.Size, t.To)
+	return true, fmt.Sprintf("Sent %s to %s (%d bytes, sha256 %s)", t.Name, t.To, t.Size, sum)
+}
+
+// abortTransfer cancels a transfer and tells both users why
+func (s *Server) abortTransfer(t *Transfer, reason string) {
+	s.transfersMu.Lock()
+	delete(s.transfers, t.ID)
+	s.transfersMu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.notifyAborted(t, reason)
+}
+
+// cancelTransfers aborts every transfer a user takes part in, used when the
+// user leaves or changes nickname, the caller must hold s.mu
+func (s *Server) cancelTransfers(nickname, reason string) {
+	var cancelled []*Transfer
+	s.transfersMu.Lock()
+	for id, t := range s.transfers {
+		if t.From == nickname || t.To == nickname {
+			delete(s.transfers, id)
+			cancelled = append(cancelled, t)
+		}
+	}
+	s.transfersMu.Unlock()
+
+	for _, t := range cancelled {
+		s.notifyAborted(t, reason)
+	}
+}
+
+// notifyAborted tells both users of a transfer that it was aborted, the
+// caller must hold s.mu
+func (s *Server) notifyAborted(t *Transfer, reason string) {
+	s.logger.Printf("Transfer %s aborted: %s", t.ID, reason)
+	for _, nick := range []string{t.From, t.To} {
+		if client, online := s.clients[nick]; online {
+			s.deliver(nick, client, Event{Type: "file-aborted", Body: reason, File: t.info(), Time: time.Now()})
+		}
+	}
+}